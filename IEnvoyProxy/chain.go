@@ -0,0 +1,226 @@
+package IEnvoyProxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// chainVia - The keyword separating the inner from the outer transport in a chain specification.
+const chainVia = "via"
+
+// chainOuter - A transport, which other transports started with `StartChain` connect through.
+type chainOuter struct {
+	// users - How many chains run through it.
+	users int
+
+	// started - Whether it was started for the chains and hence needs to be stopped with the last of them.
+	started bool
+}
+
+// StartChain - Start a transport, which connects to its server through another transport, e.g. obfs4 only
+// reachable via V2Ray behind a CDN.
+//
+// The outer transport is started first, if it isn't running already, then the inner one with the outer one's
+// local SOCKS5 listener as upstream proxy (see `Start`). Several chains can share an outer transport. Stopping
+// the last inner transport also stops the outer one, if it was started for the chains. Stopping the outer transport
+// stops all inner ones first.
+//
+// Only the V2Ray transports and `Hysteria2` can be the outer hop. Lyrebird, `Snowflake` and the TubeSocks variants
+// connect to their own server, regardless of the destination the inner transport asks for.
+//
+// `Snowflake`, `V2RaySrtp`, `V2RayWechat` and `Hysteria2` as inner hop need UDP, which only the V2Ray
+// transports and `Hysteria2` can carry (see `SupportsUdp`).
+//
+// Errors during connection are reported with `OnTransportStopped` for each hop under its own `methodName`.
+//
+// @param chain "<inner> via <outer>", using the `methodName` constants, e.g. "obfs4 via v2ray_ws" or
+// "snowflake via hysteria2".
+//
+// @returns the `methodName` of the inner transport, to be used with `Port`, `LocalAddress` and `Stop`.
+//
+// @throws if the chain specification cannot be parsed, if the outer transport cannot be an outer hop, if the inner
+// transport is already running, if the outer transport listens on a Unix domain socket or cannot carry the inner
+// transport's traffic, or if one of them fails to start.
+func (c *Controller) StartChain(chain string) (string, error) {
+	inner, outer, err := parseChain(chain)
+	if err == nil {
+		err = checkChainOuter(outer)
+	}
+
+	if err != nil {
+		ptlog.Errorf("Failed to start chain: %s", err)
+		return "", newTransportError("", ErrorKindConfig, err)
+	}
+
+	if c.running(inner) {
+		err = fmt.Errorf("chain %q: %s is already running", chain, inner)
+		ptlog.Errorf("Failed to start chain: %s", err)
+
+		return "", newTransportError(inner, ErrorKindConfig, err)
+	}
+
+	hop := c.chainOuters[outer]
+
+	if hop == nil {
+		hop = &chainOuter{started: !c.running(outer)}
+
+		if hop.started {
+			if err = c.Start(outer, ""); err != nil {
+				err = fmt.Errorf("chain %q: outer hop %s: %w", chain, outer, err)
+				ptlog.Errorf("Failed to start chain: %s", err)
+
+				return "", err
+			}
+		}
+	}
+
+	upstream, err := c.chainUpstream(inner, outer)
+	if err != nil {
+		err = newTransportError(inner, ErrorKindConfig, err)
+	} else {
+		err = c.Start(inner, upstream)
+	}
+
+	if err != nil {
+		if hop.users < 1 && hop.started {
+			c.Stop(outer)
+		}
+
+		err = fmt.Errorf("chain %q: inner hop %s: %w", chain, inner, err)
+		ptlog.Errorf("Failed to start chain: %s", err)
+
+		return "", err
+	}
+
+	hop.users++
+	c.chainOuters[outer] = hop
+	c.chains[inner] = outer
+
+	ptlog.Noticef("Launched chain: %s via %s", inner, outer)
+
+	return inner, nil
+}
+
+// parseChain - Parse a chain specification like "obfs4 via snowflake".
+func parseChain(chain string) (inner, outer string, err error) {
+	fields := strings.Fields(chain)
+
+	if len(fields) != 3 || !strings.EqualFold(fields[1], chainVia) {
+		return "", "", fmt.Errorf("invalid chain %q, expected \"<inner> %s <outer>\"", chain, chainVia)
+	}
+
+	inner, outer = fields[0], fields[2]
+
+	if inner == outer {
+		return "", "", fmt.Errorf("invalid chain %q, a transport cannot run through itself", chain)
+	}
+
+	return inner, outer, nil
+}
+
+// checkChainOuter - Check, if the given transport can be the outer hop of a chain, i.e. connects to the
+// destination the inner transport asks for.
+func checkChainOuter(outer string) error {
+	switch outer {
+	case V2RayWs, V2RaySrtp, V2RayWechat, V2RayShadowsocks, Hysteria2:
+		return nil
+
+	default:
+		return fmt.Errorf("%s cannot be an outer hop, as it only connects to its own server", outer)
+	}
+}
+
+// chainUpstream - The upstream proxy URL for the inner transport, pointing to the outer transport's listener.
+//
+// @throws if the outer transport cannot be an outer hop, listens on a Unix domain socket or cannot carry UDP for
+// the inner transport.
+func (c *Controller) chainUpstream(inner, outer string) (string, error) {
+	if err := checkChainOuter(outer); err != nil {
+		return "", err
+	}
+
+	address := c.LocalAddress(outer)
+	if address == "" {
+		return "", fmt.Errorf("%s needs to listen on TCP to be used as outer hop", outer)
+	}
+
+	// Listening on all interfaces includes loopback.
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			if ip.To4() != nil {
+				address = net.JoinHostPort("127.0.0.1", port)
+			} else {
+				address = net.JoinHostPort("::1", port)
+			}
+		}
+	}
+
+	if needsUdp(inner) && !c.SupportsUdp(outer) {
+		return "", fmt.Errorf("%s needs UDP, which %s cannot carry", inner, outer)
+	}
+
+	u := &url.URL{Scheme: "socks5", Host: address}
+
+	if auth := c.socksAuth(outer, ""); auth != nil {
+		u.User = url.UserPassword(auth.User, auth.Password)
+	}
+
+	return u.String(), nil
+}
+
+// running - Whether the given transport is running.
+func (c *Controller) running(methodName string) bool {
+	return c.LocalAddress(methodName) != "" || c.LocalSocketPath(methodName) != ""
+}
+
+// stopChain - Release the outer transport of a chain and stop it, if it was started for the chains and this was
+// the last one running through it.
+//
+// @param methodName The inner transport of the chain.
+func (c *Controller) stopChain(methodName string) {
+	outer, ok := c.chains[methodName]
+	if !ok {
+		return
+	}
+
+	delete(c.chains, methodName)
+
+	hop := c.chainOuters[outer]
+	if hop == nil {
+		// The outer transport is being stopped itself.
+		return
+	}
+
+	hop.users--
+
+	if hop.users < 1 {
+		delete(c.chainOuters, outer)
+
+		if hop.started {
+			c.Stop(outer)
+		}
+	}
+}
+
+// stopChainUsers - Stop all inner transports running through the given one, as they cannot connect without it.
+//
+// @param methodName The outer transport of the chains.
+func (c *Controller) stopChainUsers(methodName string) {
+	if _, ok := c.chainOuters[methodName]; !ok {
+		return
+	}
+
+	delete(c.chainOuters, methodName)
+
+	for inner, outer := range c.chains {
+		if outer == methodName {
+			ptlog.Noticef("Stopping %s, as its outer hop %s is stopped", inner, outer)
+
+			c.Stop(inner)
+		}
+	}
+}
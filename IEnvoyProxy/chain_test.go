@@ -0,0 +1,149 @@
+package IEnvoyProxy
+
+import (
+	"testing"
+)
+
+func TestParseChain(t *testing.T) {
+	tests := []struct {
+		chain string
+		inner string
+		outer string
+	}{
+		{"obfs4 via v2ray_ws", Obfs4, V2RayWs},
+		{"  meek_lite  VIA  hysteria2 ", MeekLite, Hysteria2},
+		{"obfs4", "", ""},
+		{"obfs4 through snowflake", "", ""},
+		{"obfs4 via obfs4", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.chain, func(t *testing.T) {
+			inner, outer, err := parseChain(tt.chain)
+
+			if tt.inner == "" {
+				if err == nil {
+					t.Errorf("parseChain() = %q, %q, want error", inner, outer)
+				}
+
+				return
+			}
+
+			if err != nil || inner != tt.inner || outer != tt.outer {
+				t.Errorf("parseChain() = %q, %q, %v, want %q, %q", inner, outer, err, tt.inner, tt.outer)
+			}
+		})
+	}
+}
+
+// startChains - Start the given chains or fail the test.
+func startChains(t *testing.T, c *Controller, chains ...string) {
+	t.Helper()
+
+	for _, chain := range chains {
+		if _, err := c.StartChain(chain); err != nil {
+			t.Fatalf("StartChain(%q) error = %v", chain, err)
+		}
+	}
+}
+
+func checkRunning(t *testing.T, c *Controller, running map[string]bool) {
+	t.Helper()
+
+	for methodName, want := range running {
+		if got := c.running(methodName); got != want {
+			t.Errorf("running(%s) = %t, want %t", methodName, got, want)
+		}
+	}
+}
+
+// newChainController - A Controller with a V2Ray server configured, so `V2RayWs` can be an outer hop.
+func newChainController(t *testing.T) *Controller {
+	t.Helper()
+
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	c.V2RayServerAddress = "192.0.2.1"
+	c.V2RayServerPort = "443"
+	c.V2RayId = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+	return c
+}
+
+func TestChainSharesOuter(t *testing.T) {
+	c := newChainController(t)
+
+	startChains(t, c, "meek_lite via v2ray_ws", "webtunnel via v2ray_ws")
+
+	c.Stop(MeekLite)
+	checkRunning(t, c, map[string]bool{MeekLite: false, Webtunnel: true, V2RayWs: true})
+
+	c.Stop(Webtunnel)
+	checkRunning(t, c, map[string]bool{Webtunnel: false, V2RayWs: false})
+
+	if len(c.chains) > 0 || len(c.chainOuters) > 0 {
+		t.Errorf("chains left over: %v, %v", c.chains, c.chainOuters)
+	}
+}
+
+func TestChainKeepsOuterStartedBefore(t *testing.T) {
+	c := newChainController(t)
+
+	if err := c.Start(V2RayWs, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(V2RayWs)
+
+	startChains(t, c, "meek_lite via v2ray_ws")
+
+	c.Stop(MeekLite)
+	checkRunning(t, c, map[string]bool{MeekLite: false, V2RayWs: true})
+}
+
+func TestChainStopsInnerWithOuter(t *testing.T) {
+	c := newChainController(t)
+
+	startChains(t, c, "meek_lite via v2ray_ws", "webtunnel via v2ray_ws")
+
+	c.Stop(V2RayWs)
+	checkRunning(t, c, map[string]bool{MeekLite: false, Webtunnel: false, V2RayWs: false})
+
+	if len(c.chains) > 0 || len(c.chainOuters) > 0 {
+		t.Errorf("chains left over: %v, %v", c.chains, c.chainOuters)
+	}
+
+	// The outer transport can be chained through again.
+	startChains(t, c, "meek_lite via v2ray_ws")
+	c.Stop(MeekLite)
+	checkRunning(t, c, map[string]bool{V2RayWs: false})
+}
+
+func TestChainRefusesRunningInner(t *testing.T) {
+	c := newChainController(t)
+
+	startChains(t, c, "meek_lite via v2ray_ws")
+	defer c.Stop(MeekLite)
+
+	if _, err := c.StartChain("meek_lite via v2ray_wechat"); ErrorKind(err) != ErrorKindConfig {
+		t.Errorf("StartChain() error = %v, want a config error", err)
+	}
+
+	// The failed chain didn't take the running one's outer hop down.
+	checkRunning(t, c, map[string]bool{MeekLite: true, V2RayWs: true, V2RayWechat: false})
+}
+
+func TestChainRefusesOuter(t *testing.T) {
+	c := newChainController(t)
+
+	// They connect to their own server instead of the inner transport's.
+	for _, outer := range []string{Obfs4, MeekLite, Webtunnel, Snowflake, Obfs4TubeSocks, MeekLiteTubeSocks} {
+		if _, err := c.StartChain("v2ray_ws via " + outer); ErrorKind(err) != ErrorKindConfig {
+			t.Errorf("StartChain(via %s) error = %v, want a config error", outer, err)
+		}
+
+		if _, err := c.chainUpstream(V2RayWs, outer); err == nil {
+			t.Errorf("chainUpstream(%s) = nil error, want error", outer)
+		}
+
+		checkRunning(t, c, map[string]bool{outer: false, V2RayWs: false})
+	}
+}
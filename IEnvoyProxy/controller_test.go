@@ -0,0 +1,413 @@
+package IEnvoyProxy
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v2ray "github.com/v2fly/v2ray-core/v5/envoy"
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+	"golang.org/x/net/proxy"
+)
+
+// fakeFactory - A `base.ClientFactory`, which records the args it parses and dials with a given function.
+type fakeFactory struct {
+	dial func(dialFn base.DialFunc) (net.Conn, error)
+
+	// config - Returned by `ParseArgs`.
+	config interface{}
+
+	mutex sync.Mutex
+	args  []pt.Args
+}
+
+func (f *fakeFactory) Transport() base.Transport {
+	return nil
+}
+
+func (f *fakeFactory) ParseArgs(args *pt.Args) (interface{}, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	parsed := pt.Args{}
+	for key, values := range *args {
+		parsed[key] = append([]string(nil), values...)
+	}
+
+	f.args = append(f.args, parsed)
+
+	return f.config, nil
+}
+
+func (f *fakeFactory) Dial(_, _ string, dialFn base.DialFunc, _ interface{}) (net.Conn, error) {
+	return f.dial(dialFn)
+}
+
+func (f *fakeFactory) OnEvent(func(base.TransportEvent)) {
+}
+
+// closeConn - A connection, which signals when it's closed.
+type closeConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newCloseConn(conn net.Conn) *closeConn {
+	return &closeConn{Conn: conn, closed: make(chan struct{})}
+}
+
+func (c *closeConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+
+	return c.Conn.Close()
+}
+
+// startFake - Run the accept loop of a Lyrebird transport with a fake factory, like `Start` does.
+//
+// @returns the address of the SOCKS listener.
+func startFake(t *testing.T, c *Controller, methodName string, f base.ClientFactory) string {
+	t.Helper()
+
+	ln, err := c.listenSocks(methodName)
+	if err != nil {
+		t.Fatalf("listenSocks() error = %v", err)
+	}
+
+	c.listeners[methodName] = ln
+	c.shutdown[methodName] = make(chan struct{})
+
+	go acceptLoop(f, ln, nil, nil, c.dialTimeouts(methodName),
+		c.shutdown[methodName], methodName, c.transportStopped)
+
+	return ln.Addr().String()
+}
+
+func waitClosed(t *testing.T, what string, closed <-chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s not closed after Stop", what)
+	}
+}
+
+// stopQuickly - Stop the transport and check, that it doesn't block.
+func stopQuickly(t *testing.T, c *Controller, methodName string) {
+	t.Helper()
+
+	done := make(chan struct{})
+
+	go func() {
+		c.Stop(methodName)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stop() blocked")
+	}
+}
+
+func TestStopCancelsHungDial(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	c.SetTimeouts(Obfs4, 60, 60)
+
+	serverAddress, accepted := silentServer(t)
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	// Like Snowflake: connects, then blocks forever and ignores the connection being closed.
+	f := &fakeFactory{dial: func(dialFn base.DialFunc) (net.Conn, error) {
+		if _, err := dialFn("tcp", serverAddress); err != nil {
+			return nil, err
+		}
+
+		<-unblock
+
+		return nil, errors.New("unblocked")
+	}}
+
+	dialer, err := proxy.SOCKS5("tcp", startFake(t, c, Obfs4, f), nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientDone := make(chan struct{})
+
+	go func() {
+		if conn, err := dialer.Dial("tcp", "192.0.2.1:443"); err == nil {
+			_ = conn.Close()
+			t.Error("Dial() succeeded, want error")
+		}
+
+		close(clientDone)
+	}()
+
+	var remote net.Conn
+
+	select {
+	case remote = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("transport didn't connect to the server")
+	}
+
+	stopQuickly(t, c, Obfs4)
+
+	waitClosed(t, "client connection", clientDone)
+
+	remoteClosed := make(chan struct{})
+
+	go func() {
+		_, _ = remote.Read(make([]byte, 1))
+		close(remoteClosed)
+	}()
+
+	waitClosed(t, "server connection", remoteClosed)
+}
+
+func TestStopClosesStuckRemote(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+
+	remotes := make(chan *closeConn, 1)
+
+	// The remote end never reads, so relaying to it blocks.
+	f := &fakeFactory{dial: func(base.DialFunc) (net.Conn, error) {
+		local, _ := net.Pipe()
+		remote := newCloseConn(local)
+		remotes <- remote
+
+		return remote, nil
+	}}
+
+	dialer, err := proxy.SOCKS5("tcp", startFake(t, c, Obfs4, f), nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.Dial("tcp", "192.0.2.1:443")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write(make([]byte, 64*1024)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	remote := <-remotes
+
+	clientClosed := make(chan struct{})
+
+	go func() {
+		_, _ = conn.Read(make([]byte, 1))
+		close(clientClosed)
+	}()
+
+	stopQuickly(t, c, Obfs4)
+
+	waitClosed(t, "client connection", clientClosed)
+	waitClosed(t, "transport connection", remote.closed)
+}
+
+func TestV2RayWsOptions(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	c.V2RaySni = "front.example"
+	c.V2RayHost = "real.example"
+	c.V2RayFingerprint = "chrome_auto"
+	c.V2RayPinnedCertSha256 = " 47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=,,"
+
+	options, err := c.v2rayWsOptions()
+	if err != nil {
+		t.Fatalf("v2rayWsOptions() error = %v", err)
+	}
+
+	want := v2ray.WsOptions{
+		ServerName:       "front.example",
+		Host:             "real.example",
+		Fingerprint:      "chrome_auto",
+		PinnedCertSha256: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+	}
+
+	if !reflect.DeepEqual(options, want) {
+		t.Errorf("v2rayWsOptions() = %+v, want %+v", options, want)
+	}
+
+	for _, hash := range []string{"not base64!", "AAAA"} {
+		c.V2RayPinnedCertSha256 = hash
+
+		if _, err := c.v2rayWsOptions(); err == nil {
+			t.Errorf("v2rayWsOptions() with hash %q: want error", hash)
+		}
+	}
+}
+
+func TestSupportsUdp(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+
+	for methodName, want := range map[string]bool{
+		Obfs4: false, MeekLite: false, Webtunnel: false, Snowflake: false, Obfs4TubeSocks: false,
+		MeekLiteTubeSocks: false, V2RayWs: true, V2RaySrtp: true, V2RayWechat: true, V2RayShadowsocks: true,
+		Hysteria2: true,
+	} {
+		if got := c.SupportsUdp(methodName); got != want {
+			t.Errorf("SupportsUdp(%s) = %v, want %v", methodName, got, want)
+		}
+	}
+
+	if err := c.SetListenUnixSocket(V2RaySrtp, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.SupportsUdp(V2RaySrtp) {
+		t.Error("SupportsUdp() = true on a Unix domain socket")
+	}
+}
+
+func TestStartV2RayInboundUdp(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	port := 0
+
+	start := func(upstream *url.URL) v2ray.Inbound {
+		t.Helper()
+
+		var started v2ray.Inbound
+
+		err := c.startV2Ray(V2RayWechat, &port, upstream, func(inbound v2ray.Inbound, _ v2ray.Upstream) error {
+			started = inbound
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return started
+	}
+
+	if inbound := start(nil); !inbound.UDP || inbound.Port != port {
+		t.Errorf("TCP inbound = %+v, want UDP on port %d", inbound, port)
+	}
+
+	// HTTP proxies can't relay UDP.
+	if inbound := start(&url.URL{Scheme: "http", Host: "127.0.0.1:8080"}); inbound.UDP {
+		t.Errorf("inbound behind HTTP proxy = %+v, want no UDP", inbound)
+	}
+
+	if err := c.SetListenUnixSocket(V2RayWechat, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if inbound := start(nil); inbound.UDP {
+		t.Errorf("Unix domain socket inbound = %+v, want no UDP", inbound)
+	}
+}
+
+func TestLocalAddressRecordedAtStart(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	port := 0
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	free := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	if err = c.SetListenAddress(V2RayWechat, "0.0.0.0:"+strconv.Itoa(free)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.startV2Ray(V2RayWechat, &port, nil, func(v2ray.Inbound, v2ray.Upstream) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := net.JoinHostPort("0.0.0.0", strconv.Itoa(port))
+
+	// Changes only take effect with the next start.
+	if err = c.SetListenAddress(V2RayWechat, "127.0.0.2:1080"); err != nil {
+		t.Fatal(err)
+	}
+
+	if address := c.LocalAddress(V2RayWechat); address != want {
+		t.Errorf("LocalAddress() = %q, want %q", address, want)
+	}
+
+	if p := c.Port(V2RayWechat); p != port {
+		t.Errorf("Port() = %d, want %d", p, port)
+	}
+
+	// Listening on all interfaces is reachable through loopback.
+	upstream, err := c.chainUpstream(Obfs4, V2RayWechat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want = "socks5://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)); upstream != want {
+		t.Errorf("chainUpstream() = %q, want %q", upstream, want)
+	}
+
+	c.Stop(V2RayWechat)
+
+	if address := c.LocalAddress(V2RayWechat); address != "" {
+		t.Errorf("LocalAddress() after Stop = %q, want \"\"", address)
+	}
+}
+
+func TestStartURIResetsSettings(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+
+	c.V2RaySni = "old.example"
+	c.V2RayHost = "old.example"
+	c.V2RayFingerprint = "firefox_auto"
+	c.V2RayAllowInsecure = true
+	c.V2RayPinnedCertSha256 = "not a hash"
+	c.V2RaySsMethod = "aes-128-gcm"
+	c.Hysteria2Server = "hysteria2://old@old.example"
+
+	methodName, err := c.StartURI("vless://a3482e88-686a-4a58-8126-99c9df64b7bf@new.example:443" +
+		"?type=ws&security=tls&path=%2Fws")
+	if err != nil {
+		t.Fatalf("StartURI() error = %v", err)
+	}
+	defer c.Stop(methodName)
+
+	if methodName != V2RayWs {
+		t.Errorf("StartURI() = %q, want %q", methodName, V2RayWs)
+	}
+
+	if c.V2RayServerAddress != "new.example" || c.V2RayWsPath != "/ws" || c.V2RayProtocol != "vless" {
+		t.Errorf("link not applied: %q %q %q", c.V2RayServerAddress, c.V2RayWsPath, c.V2RayProtocol)
+	}
+
+	if c.V2RaySni != "" || c.V2RayHost != "" || c.V2RayFingerprint != "" || c.V2RayAllowInsecure ||
+		c.V2RayPinnedCertSha256 != "" {
+		t.Errorf("previous settings leaked: %+v", c)
+	}
+
+	// Settings of other transports are left alone.
+	if c.V2RaySsMethod != "aes-128-gcm" || c.Hysteria2Server != "hysteria2://old@old.example" {
+		t.Errorf("settings of other transports changed: %q %q", c.V2RaySsMethod, c.Hysteria2Server)
+	}
+
+	_, err = c.StartURI("trojan://secret@other.example:443?type=ws&security=tls")
+	if err == nil || ErrorKind(err) != ErrorKindConfig || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("StartURI() while running error = %v, want %s error", err, ErrorKindConfig)
+	}
+
+	if c.V2RayServerAddress != "new.example" || c.V2RayProtocol != "vless" {
+		t.Errorf("settings of running transport changed: %q %q", c.V2RayServerAddress, c.V2RayProtocol)
+	}
+}
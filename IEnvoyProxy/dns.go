@@ -0,0 +1,402 @@
+package IEnvoyProxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTimeout  = 10 * time.Second
+	dnsMinTTL   = 30 * time.Second
+	dnsMaxTTL   = time.Hour
+	dnsMimeType = "application/dns-message"
+
+	// dnsNegativeTTL - How long to cache an answer without addresses at most, so a domain which just got an
+	// A or AAAA record isn't missed for long.
+	dnsNegativeTTL = time.Minute
+)
+
+// dnsUpstream - A DNS-over-HTTPS or DNS-over-TLS server.
+type dnsUpstream struct {
+	endpoint  string
+	url       *url.URL
+	host      string
+	port      string
+	bootstrap []string
+	client    *http.Client
+}
+
+// AddDnsResolver - Resolve the transports' server hostnames with the given DNS-over-HTTPS or DNS-over-TLS server
+// instead of the system resolver, which is easily poisoned by censors.
+//
+// Resolvers are tried in the order they were added, until one answers. Only if none do, the system resolver
+// is used, if enabled with `SetDnsSystemFallback`. Answers are cached according to their TTL.
+// Pinned domains (see `PinDomainIPs`) always take precedence.
+//
+// Like pins, resolvers are process-wide, so they are shared by all `Controller`s. Takes effect with the next
+// connection, no restart needed, except for Hysteria2. Snowflake resolves its broker, front and ICE server domains
+// with the system resolver, so it refuses to start while resolvers are configured, unless `SetDnsSystemFallback`
+// allows the system resolver.
+//
+// @param endpoint A DoH URL like "https://dns.example.com/dns-query" or a DoT address like "tls://dns.example.com:853".
+// Plain "http://" is only accepted for loopback addresses, for testing.
+//
+// @param commaSeparatedBootstrapIPs IP addresses of the resolver, if its endpoint contains a hostname.
+// If empty, the hostname is looked up with pins and then the system resolver.
+//
+// @throws if the endpoint or bootstrap IP addresses are invalid.
+func (c *Controller) AddDnsResolver(endpoint, commaSeparatedBootstrapIPs string) error {
+	upstream, err := newDnsUpstream(strings.TrimSpace(endpoint), commaSeparatedBootstrapIPs)
+	if err != nil {
+		return err
+	}
+
+	sharedResolver.addUpstream(upstream)
+
+	ptlog.Noticef("Added DNS resolver %s", ptlog.ElideAddr(upstream.host))
+
+	return nil
+}
+
+// ClearDnsResolvers - Remove all resolvers added with `AddDnsResolver` and resolve with the system resolver again.
+func (c *Controller) ClearDnsResolvers() {
+	sharedResolver.clearUpstreams()
+
+	ptlog.Noticef("Cleared DNS resolvers")
+}
+
+// SetDnsSystemFallback - Use the system resolver, when none of the resolvers added with `AddDnsResolver` answers.
+//
+// Off by default, as the system resolver might return poisoned answers.
+//
+// @param enabled true to fall back to the system resolver.
+func (c *Controller) SetDnsSystemFallback(enabled bool) {
+	sharedResolver.setSystemFallback(enabled)
+}
+
+func newDnsUpstream(endpoint, commaSeparatedBootstrapIPs string) (*dnsUpstream, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS resolver %q: %w", endpoint, err)
+	}
+
+	upstream := &dnsUpstream{
+		endpoint: endpoint,
+		url:      u,
+		host:     u.Hostname(),
+		port:     u.Port(),
+	}
+
+	if upstream.host == "" {
+		return nil, fmt.Errorf("DNS resolver %q contains no host", endpoint)
+	}
+
+	switch u.Scheme {
+	case "https":
+		if upstream.port == "" {
+			upstream.port = "443"
+		}
+
+	case "http":
+		ip := net.ParseIP(upstream.host)
+		if upstream.host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("DNS resolver %q: plain HTTP is only allowed on loopback", endpoint)
+		}
+
+		if upstream.port == "" {
+			upstream.port = "80"
+		}
+
+	case "tls":
+		if upstream.port == "" {
+			upstream.port = "853"
+		}
+
+	default:
+		return nil, fmt.Errorf("DNS resolver %q: unsupported scheme %q", endpoint, u.Scheme)
+	}
+
+	for _, ip := range strings.Split(commaSeparatedBootstrapIPs, ",") {
+		ip = strings.TrimSpace(ip)
+		if ip == "" {
+			continue
+		}
+
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("not an IP address: %q", ip)
+		}
+
+		upstream.bootstrap = append(upstream.bootstrap, ip)
+	}
+
+	upstream.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:         upstream.dial,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: dnsTimeout,
+			MaxIdleConns:        2,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: dnsTimeout,
+	}
+
+	return upstream, nil
+}
+
+// dial - Connect to the resolver's bootstrap IP addresses, or to its host, looked up without going through ourselves.
+func (u *dnsUpstream) dial(ctx context.Context, network, _ string) (net.Conn, error) {
+	ips := u.bootstrap
+
+	if len(ips) < 1 {
+		ips = sharedResolver.pinned(u.host)
+	}
+
+	if len(ips) < 1 {
+		if net.ParseIP(u.host) != nil {
+			ips = []string{u.host}
+		} else {
+			addrs, err := systemResolver.LookupHost(ctx, u.host)
+			if err != nil {
+				return nil, err
+			}
+
+			ips = addrs
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: dnsTimeout, Resolver: systemResolver}
+
+	var lastErr error
+
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, u.port))
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// exchange - Send a DNS query to the resolver and return its response.
+func (u *dnsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if u.url.Scheme == "tls" {
+		return u.exchangeTls(ctx, query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", dnsMimeType)
+	req.Header.Set("Accept", dnsMimeType)
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d", res.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(res.Body, 65535))
+}
+
+// exchangeTls - Send a DNS query over a new TLS connection, as per RFC 7858.
+func (u *dnsUpstream) exchangeTls(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	conn, err := u.dial(ctx, "tcp", "")
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: u.host})
+
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(tlsConn)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = tlsConn.SetDeadline(deadline)
+	}
+
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(query)))
+
+	if _, err = tlsConn.Write(append(length, query...)); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(tlsConn, length); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, binary.BigEndian.Uint16(length))
+
+	if _, err = io.ReadFull(tlsConn, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// resolve - Look up the A or AAAA records of a domain with this resolver.
+//
+// @returns the IP addresses and how long they may be cached.
+func (u *dnsUpstream) resolve(ctx context.Context, domain string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(domain + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// ID 0, as recommended for DoH by RFC 8484, to improve HTTP caching.
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+
+	if err = b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	if err = b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+
+	query, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, err := u.exchange(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var p dnsmessage.Parser
+
+	header, err := p.Start(response)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: domain, Server: u.host, IsNotFound: true}
+
+	default:
+		return nil, 0, fmt.Errorf("DNS error %s", header.RCode)
+	}
+
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	ttl := dnsMaxTTL
+
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if rh.Type != qtype {
+			if err = p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+
+			continue
+		}
+
+		switch qtype {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+
+			ips = append(ips, r.A[:])
+
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+
+			ips = append(ips, r.AAAA[:])
+		}
+
+		ttl = min(ttl, time.Duration(rh.TTL)*time.Second)
+	}
+
+	if len(ips) < 1 {
+		ttl, err = negativeTTL(&p)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return ips, max(ttl, dnsMinTTL), nil
+}
+
+// negativeTTL - How long an answer without addresses may be cached: The zone's SOA minimum as per RFC 2308,
+// if the resolver sent one, but never longer than `dnsNegativeTTL`.
+//
+// @param p A parser positioned at the authority section.
+func negativeTTL(p *dnsmessage.Parser) (time.Duration, error) {
+	ttl := dnsNegativeTTL
+
+	for {
+		rh, err := p.AuthorityHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return ttl, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if rh.Type != dnsmessage.TypeSOA {
+			if err = p.SkipAuthority(); err != nil {
+				return 0, err
+			}
+
+			continue
+		}
+
+		soa, err := p.SOAResource()
+		if err != nil {
+			return 0, err
+		}
+
+		ttl = min(ttl, time.Duration(min(rh.TTL, soa.MinTTL))*time.Second)
+	}
+}
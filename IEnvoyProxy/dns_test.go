@@ -0,0 +1,222 @@
+package IEnvoyProxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newTestResolver - A resolver answering from the given pins only.
+func newTestResolver(pins map[string][]string) *resolver {
+	r := newResolver()
+	r.pins = pins
+
+	return r
+}
+
+// dohServer - A DNS-over-HTTPS server answering with the given function.
+//
+// @returns an upstream, which trusts the server's certificate.
+func dohServer(t *testing.T, answer func(query []byte) ([]byte, error)) *dnsUpstream {
+	t.Helper()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dnsMimeType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		query, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response, err := answer(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", dnsMimeType)
+		_, _ = w.Write(response)
+	}))
+
+	t.Cleanup(server.Close)
+
+	upstream, err := newDnsUpstream(server.URL+"/dns-query", "")
+	if err != nil {
+		t.Fatalf("newDnsUpstream() error = %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	upstream.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: roots}
+
+	return upstream
+}
+
+func TestDnsUpstreamResolve(t *testing.T) {
+	server := newTestResolver(map[string][]string{
+		"v4.example":   {"192.0.2.1", "192.0.2.2"},
+		"dual.example": {"192.0.2.3", "2001:db8::3"},
+	})
+	upstream := dohServer(t, server.answer)
+
+	tests := []struct {
+		name   string
+		domain string
+		qtype  dnsmessage.Type
+		want   []string
+		maxTtl time.Duration
+	}{
+		{"A", "v4.example", dnsmessage.TypeA, []string{"192.0.2.1", "192.0.2.2"}, pinnedTTL * time.Second},
+		{"AAAA", "dual.example", dnsmessage.TypeAAAA, []string{"2001:db8::3"}, pinnedTTL * time.Second},
+		{"NODATA", "v4.example", dnsmessage.TypeAAAA, nil, dnsNegativeTTL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, ttl, err := upstream.resolve(context.Background(), tt.domain, tt.qtype)
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+
+			if len(ips) != len(tt.want) {
+				t.Fatalf("resolve() = %v, want %v", ips, tt.want)
+			}
+
+			for i, ip := range ips {
+				if !ip.Equal(net.ParseIP(tt.want[i])) {
+					t.Errorf("resolve() = %v, want %v", ips, tt.want)
+				}
+			}
+
+			if ttl < dnsMinTTL || ttl > tt.maxTtl {
+				t.Errorf("resolve() TTL = %s, want between %s and %s", ttl, dnsMinTTL, tt.maxTtl)
+			}
+		})
+	}
+}
+
+func TestDnsUpstreamNegativeTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		soaTtl uint32
+		minTtl uint32
+		want   time.Duration
+	}{
+		{"SOA minimum", 3600, 45, 45 * time.Second},
+		{"SOA TTL", 40, 3600, 40 * time.Second},
+		{"capped", 86400, 86400, dnsNegativeTTL},
+		{"at least minimum TTL", 5, 5, dnsMinTTL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := dohServer(t, func(query []byte) ([]byte, error) {
+				return noDataWithSoa(query, tt.soaTtl, tt.minTtl)
+			})
+
+			ips, ttl, err := upstream.resolve(context.Background(), "example.com", dnsmessage.TypeA)
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+
+			if len(ips) != 0 || ttl != tt.want {
+				t.Errorf("resolve() = %v, %s, want no addresses and %s", ips, ttl, tt.want)
+			}
+		})
+	}
+}
+
+func TestDnsUpstreamServerFailure(t *testing.T) {
+	// The server's only upstream is unreachable, so it answers with SERVFAIL.
+	dead, err := newDnsUpstream("http://127.0.0.1:1/dns-query", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestResolver(map[string][]string{})
+	server.upstreams = []*dnsUpstream{dead}
+
+	upstream := dohServer(t, server.answer)
+
+	if _, _, err = upstream.resolve(context.Background(), "example.com", dnsmessage.TypeA); err == nil {
+		t.Fatal("resolve() succeeded, want error")
+	}
+}
+
+func TestResolverLookupCaches(t *testing.T) {
+	server := newTestResolver(map[string][]string{"cached.example": {"192.0.2.1"}})
+	upstream := dohServer(t, server.answer)
+
+	r := newTestResolver(map[string][]string{})
+	r.upstreams = []*dnsUpstream{upstream}
+
+	ips, err := r.lookup(context.Background(), "Cached.Example.", dnsmessage.TypeA)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("lookup() = %v, %v", ips, err)
+	}
+
+	// Served from the cache, even though the server forgot the domain.
+	server.unpin("cached.example")
+
+	ips, err = r.lookup(context.Background(), "cached.example", dnsmessage.TypeA)
+	if err != nil || len(ips) != 1 {
+		t.Fatalf("lookup() = %v, %v, want cached answer", ips, err)
+	}
+}
+
+// noDataWithSoa - Answer a query without records, but with the SOA of the zone.
+func noDataWithSoa(query []byte, soaTtl, minTtl uint32) ([]byte, error) {
+	var p dnsmessage.Parser
+
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	header.Response = true
+
+	b := dnsmessage.NewBuilder(nil, header)
+
+	if err = b.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	if err = b.Question(question); err != nil {
+		return nil, err
+	}
+
+	if err = b.StartAuthorities(); err != nil {
+		return nil, err
+	}
+
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: soaTtl}
+
+	err = b.SOAResource(rh, dnsmessage.SOAResource{
+		NS:     dnsmessage.MustNewName("ns.example.com."),
+		MBox:   dnsmessage.MustNewName("hostmaster.example.com."),
+		MinTTL: minTtl,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Finish()
+}
@@ -0,0 +1,201 @@
+package IEnvoyProxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+//goland:noinspection GoUnusedConst
+const (
+	// ErrorKindConfig - The transport is misconfigured, e.g. a missing or invalid setting, an unknown
+	// `methodName` or an unsupported proxy. Retrying won't help.
+	ErrorKindConfig = "config"
+
+	// ErrorKindListen - No local port or socket could be bound to listen on.
+	ErrorKindListen = "listen"
+
+	// ErrorKindDns - A hostname could not be resolved.
+	ErrorKindDns = "dns"
+
+	// ErrorKindConnection - The connection was refused, reset or closed by the other end, or the network is
+	// unreachable.
+	ErrorKindConnection = "connection"
+
+	// ErrorKindTls - The TLS handshake failed, e.g. because the certificate didn't verify or a pinned
+	// certificate didn't match.
+	ErrorKindTls = "tls"
+
+	// ErrorKindTimeout - The other end didn't answer in time.
+	ErrorKindTimeout = "timeout"
+
+	// ErrorKindAuth - The server or an upstream proxy rejected the credentials.
+	ErrorKindAuth = "auth"
+
+	// ErrorKindUnknown - The error could not be classified.
+	ErrorKindUnknown = "unknown"
+)
+
+// errorKinds - All kinds, in the order they are checked in a message.
+var errorKinds = []string{ErrorKindConfig, ErrorKindListen, ErrorKindDns, ErrorKindConnection, ErrorKindTls,
+	ErrorKindTimeout, ErrorKindAuth, ErrorKindUnknown}
+
+// TransportError - An error of a transport, classified by kind.
+//
+// Returned by `Start`, `StartURI` and `StartChain` and handed to `OnTransportStopped` and `OnSnowflakeEvent`.
+//
+// The message contains the kind in brackets, like "[timeout] obfs4: ...", as the bindings turn errors into
+// plain exceptions. Use `ErrorKind` to get it back.
+type TransportError struct {
+	// Kind - One of the `ErrorKind*` constants.
+	Kind string
+
+	// Transport - The `methodName` of the transport, which failed. Empty, if it's unknown, e.g. when a share
+	// link cannot be parsed.
+	Transport string
+
+	err error
+}
+
+// Error - Implements `error`.
+func (e *TransportError) Error() string {
+	if e.Transport == "" {
+		return fmt.Sprintf("[%s] %s", e.Kind, e.err)
+	}
+
+	return fmt.Sprintf("[%s] %s: %s", e.Kind, e.Transport, e.err)
+}
+
+// Unwrap - The underlying error.
+func (e *TransportError) Unwrap() error {
+	return e.err
+}
+
+// ErrorKind - The kind of error.
+//
+// @param err An error returned or reported by a `Controller`.
+//
+// @returns one of the `ErrorKind*` constants. Empty, if err is nil.
+//
+//goland:noinspection GoUnusedExportedFunction
+func ErrorKind(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var te *TransportError
+	if errors.As(err, &te) {
+		return te.Kind
+	}
+
+	// Errors which went through the bindings lose their type, but keep their message.
+	message := err.Error()
+
+	for _, kind := range errorKinds {
+		if strings.Contains(message, "["+kind+"] ") {
+			return kind
+		}
+	}
+
+	return classifyError(err)
+}
+
+// newTransportError - Attach a kind to an error, unless it already has one.
+//
+// @param kind One of the `ErrorKind*` constants, or empty to classify the error by what it wraps.
+//
+// @returns nil, if err is nil.
+func newTransportError(methodName, kind string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var te *TransportError
+	if errors.As(err, &te) {
+		return err
+	}
+
+	if kind == "" {
+		kind = classifyError(err)
+	}
+
+	return &TransportError{Kind: kind, Transport: methodName, err: err}
+}
+
+// classifyError - Determine the kind of error from the errors it wraps or, as most transports only return
+// strings, from its message.
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrorKindDns
+	}
+
+	var recordHeaderErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	if errors.As(err, &recordHeaderErr) || errors.As(err, &alertErr) || errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return ErrorKindTls
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorKindTimeout
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return ErrorKindConnection
+	}
+
+	if errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return ErrorKindListen
+	}
+
+	message := strings.ToLower(err.Error())
+
+	for _, pattern := range errorMessagePatterns {
+		for _, substring := range pattern.substrings {
+			if strings.Contains(message, substring) {
+				return pattern.kind
+			}
+		}
+	}
+
+	return ErrorKindUnknown
+}
+
+// errorMessagePatterns - Lower case substrings of the messages of V2Ray, Hysteria2, Lyrebird, Snowflake and
+// upstream proxies, by kind. Checked in order.
+//
+// Only specific phrases, as messages often mention words like "invalid" or "certificate" for other reasons, e.g.
+// obfs4's "invalid handshake", when a censor interferes.
+var errorMessagePatterns = []struct {
+	kind       string
+	substrings []string
+}{
+	{ErrorKindAuth, []string{"authentication error", "authentication failed", "authentication required",
+		"unauthorized", "invalid username or password", "username/password", "server rejects account"}},
+	{ErrorKindDns, []string{"no such host", "server misbehaving", "failed to get ip address for domain"}},
+	{ErrorKindTls, []string{"tls:", "x509:", "peer cert is unrecognized", "utls handshake"}},
+	{ErrorKindTimeout, []string{"timeout", "timed out", "deadline exceeded", "no recent network activity"}},
+	{ErrorKindConnection, []string{"connection refused", "connection reset", "broken pipe", "network is unreachable",
+		"no route to host", "unexpected eof", ": eof", "closed network connection", "refused to connect"}},
+	{ErrorKindListen, []string{"address already in use", "bind: "}},
+	{ErrorKindConfig, []string{"invalid config", "missing argument", "unsupported argument", "failed to decode cert",
+		"malformed", "not supported", "does not support", "unknown cipher method", "no such method"}},
+}
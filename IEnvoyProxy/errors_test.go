@@ -0,0 +1,120 @@
+package IEnvoyProxy
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		// Typed errors.
+		{"DNS", &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}, ErrorKindDns},
+		{"x509", fmt.Errorf("dial: %w", x509.UnknownAuthorityError{}), ErrorKindTls},
+		{"deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), ErrorKindTimeout},
+		{"net timeout", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, ErrorKindTimeout},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			ErrorKindConnection},
+		{"EOF", fmt.Errorf("read: %w", io.EOF), ErrorKindConnection},
+		{"in use", defaultListenAddress(1080).inUse(), ErrorKindListen},
+
+		// V2Ray, whose errors don't unwrap.
+		{"V2Ray refused", errors.New("transport/internet/websocket: failed to dial WebSocket > " +
+			"transport/internet/websocket: failed to dial to (wss://[scrubbed]/): > dial tcp [scrubbed]: " +
+			"connect: connection refused"), ErrorKindConnection},
+		{"V2Ray TLS", errors.New("transport/internet/tls: peer cert is unrecognized: AAAA"), ErrorKindTls},
+		{"V2Ray x509", errors.New("transport/internet/websocket: failed to dial WebSocket > " +
+			"tls: failed to verify certificate: x509: certificate signed by unknown authority"), ErrorKindTls},
+		{"V2Ray DNS", errors.New("app/dns: failed to get IP address for domain example.com"), ErrorKindDns},
+		{"V2Ray in use", errors.New("app/proxyman/inbound: failed to listen TCP on 1080 > " +
+			"listen tcp 127.0.0.1:1080: bind: address already in use"), ErrorKindListen},
+		{"V2Ray cipher", errors.New("proxy/shadowsocks: unknown cipher method: rot13"), ErrorKindConfig},
+		{"V2Ray auth", errors.New("proxy/socks: server rejects account: 1"), ErrorKindAuth},
+		{"V2Ray EOF", errors.New("proxy/vmess/outbound: failed to read header > unexpected EOF"),
+			ErrorKindConnection},
+
+		// Hysteria2.
+		{"Hysteria2 auth", errors.New("authentication error, HTTP status code: 404"), ErrorKindAuth},
+		{"Hysteria2 idle", errors.New("connect error: timeout: no recent network activity"), ErrorKindTimeout},
+		{"Hysteria2 TLS", errors.New("connect error: CRYPTO_ERROR 0x12a (local): tls: failed to verify " +
+			"certificate: x509: certificate is valid for a.example, not b.example"), ErrorKindTls},
+		{"Hysteria2 config", errors.New("invalid config: server: missing host"), ErrorKindConfig},
+
+		// Lyrebird.
+		{"obfs4 cert", errors.New("failed to decode cert: illegal base64 data at input byte 4"), ErrorKindConfig},
+		{"obfs4 argument", errors.New("missing argument 'cert'"), ErrorKindConfig},
+		{"meek_lite URL", errors.New("malformed url: 'https//x'"), ErrorKindConfig},
+		{"obfs4 reset", errors.New("read tcp 127.0.0.1:4000->[scrubbed]: read: connection reset by peer"),
+			ErrorKindConnection},
+		{"HTTP proxy", errors.New("HTTP proxy refused to connect: 403 Forbidden"), ErrorKindConnection},
+		{"HTTP proxy auth", errors.New("HTTP proxy refused to connect: 407 Proxy Authentication Required"),
+			ErrorKindAuth},
+
+		// Not what they seem.
+		{"obfs4 handshake", errors.New("invalid handshake"), ErrorKindUnknown},
+		{"ntor", errors.New("handshake: ntor handshake failure"), ErrorKindUnknown},
+		{"framing", errors.New("framing: More data needed to decode"), ErrorKindUnknown},
+		{"certificate", errors.New("failed to create a new certificate for example.com"), ErrorKindUnknown},
+		{"reopen", errors.New("failed to reopen state file"), ErrorKindUnknown},
+		{"Snowflake", errors.New("no proxy"), ErrorKindUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError(%q) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"typed", newTransportError(Obfs4, ErrorKindAuth, errors.New("timed out")), ErrorKindAuth},
+		{"wrapped", fmt.Errorf("chain: %w", newTransportError(Obfs4, ErrorKindTls, io.EOF)), ErrorKindTls},
+		{"bindings", errors.New("[timeout] obfs4: i/o timeout"), ErrorKindTimeout},
+		{"bindings without transport", errors.New("[config] invalid share link"), ErrorKindConfig},
+		{"unknown brackets", errors.New("[scrubbed] refused to connect"), ErrorKindConnection},
+		{"unclassified", errors.New("something else"), ErrorKindUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ErrorKind(tt.err); got != tt.want {
+				t.Errorf("ErrorKind(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTransportError(t *testing.T) {
+	if err := newTransportError(Obfs4, ErrorKindConfig, nil); err != nil {
+		t.Errorf("newTransportError(nil) = %v, want nil", err)
+	}
+
+	inner := newTransportError(MeekLite, ErrorKindTls, errors.New("tls: bad certificate"))
+
+	// The first kind sticks.
+	if err := newTransportError(Obfs4, ErrorKindConfig, inner); err != inner {
+		t.Errorf("newTransportError() = %v, want %v", err, inner)
+	}
+
+	if want := "[tls] meek_lite: tls: bad certificate"; inner.Error() != want {
+		t.Errorf("Error() = %q, want %q", inner.Error(), want)
+	}
+}
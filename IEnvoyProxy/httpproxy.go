@@ -0,0 +1,320 @@
+package IEnvoyProxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"golang.org/x/net/proxy"
+)
+
+// defaultHttpPort - The port to try first for HTTP proxy front-ends.
+const defaultHttpPort = 48200
+
+// Hop-by-hop headers, which must not be forwarded. See RFC 9110, section 7.6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpProxy - An HTTP CONNECT and plain HTTP forward proxy in front of a transport's SOCKS5 listener.
+type httpProxy struct {
+	methodName string
+	server     *http.Server
+	listener   net.Listener
+	dialer     proxy.ContextDialer
+	transport  *http.Transport
+	creds      *socksCredentials
+	shutdown   chan struct{}
+}
+
+// StartHttpProxy - Start an HTTP proxy in front of the given, already running transport, for HTTP stacks which
+// handle HTTP proxies better than SOCKS5.
+//
+// It supports HTTP CONNECT and plain HTTP forwarding. If credentials are set for the transport
+// (see `SetSocksCredentials`), the same credentials are required with HTTP Basic proxy authentication.
+//
+// Stopped together with the transport.
+//
+// @param methodName one of the constants `Obfs4`, `MeekLite`, `Webtunnel`, `Snowflake`, `Obfs4TubeSocks`,
+// `MeekLiteTubeSocks`, `V2RayWs`, `V2RaySrtp`, `V2RayWechat`, `V2RayShadowsocks` or `Hysteria2`.
+//
+// @param address Where to listen, e.g. "127.0.0.1:8080" or "127.0.0.1:8080-8089". If empty, a free port on
+// loopback is chosen.
+//
+// @param ptArgs PT arguments for Lyrebird transports, e.g. "cert=...;iat-mode=0". Ignored for all others.
+//
+// @throws if the transport is not running, if the address is invalid or if no port is free.
+func (c *Controller) StartHttpProxy(methodName, address, ptArgs string) error {
+	if _, ok := c.httpProxies[methodName]; ok {
+		return nil
+	}
+
+	la := defaultListenAddress(defaultHttpPort)
+
+	if strings.TrimSpace(address) != "" {
+		var err error
+
+		la, err = parseListenAddress(address)
+		if err != nil {
+			return err
+		}
+	}
+
+	dialer, err := c.socksDialer(methodName, ptArgs)
+	if err != nil {
+		ptlog.Errorf("Failed to start HTTP proxy for %s: %s", methodName, err)
+		return err
+	}
+
+	reservation, err := reservePort(la)
+	if err != nil {
+		ptlog.Errorf("Failed to start HTTP proxy for %s: %s", methodName, err)
+		return err
+	}
+
+	p := &httpProxy{
+		methodName: methodName,
+		listener:   reservation.listener(),
+		dialer:     dialer,
+		creds:      c.credentials[methodName],
+		shutdown:   make(chan struct{}),
+	}
+
+	p.transport = &http.Transport{
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        16,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 30 * time.Second,
+	}
+
+	p.server = &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	c.httpProxies[methodName] = p
+
+	go func() {
+		_ = p.server.Serve(p.listener)
+	}()
+
+	ptlog.Noticef("Launched HTTP proxy for %s", methodName)
+
+	return nil
+}
+
+// StopHttpProxy - Stop the HTTP proxy in front of the given transport. The transport keeps running.
+//
+// @param methodName one of the constants given to `StartHttpProxy`.
+func (c *Controller) StopHttpProxy(methodName string) {
+	if p, ok := c.httpProxies[methodName]; ok {
+		ptlog.Noticef("Shutting down HTTP proxy for %s", methodName)
+
+		_ = p.server.Close()
+		p.transport.CloseIdleConnections()
+		close(p.shutdown)
+		delete(c.httpProxies, methodName)
+	}
+}
+
+// HttpPort - Port of the HTTP proxy in front of the given transport.
+//
+// @param methodName one of the constants given to `StartHttpProxy`.
+//
+// @returns port number where the HTTP proxy listens or 0, if it isn't running.
+func (c *Controller) HttpPort(methodName string) int {
+	if p, ok := c.httpProxies[methodName]; ok {
+		return p.listener.Addr().(*net.TCPAddr).Port
+	}
+
+	return 0
+}
+
+// socksDialer - A dialer connecting through the SOCKS5 listener of the given transport.
+//
+// @throws if the transport is not running.
+func (c *Controller) socksDialer(methodName, ptArgs string) (proxy.ContextDialer, error) {
+	network, address := "tcp", c.LocalAddress(methodName)
+
+	if path := c.LocalSocketPath(methodName); path != "" {
+		network, address = "unix", path
+	}
+
+	if address == "" {
+		return nil, fmt.Errorf("%s is not running", methodName)
+	}
+
+	dialer, err := proxy.SOCKS5(network, address, c.socksAuth(methodName, ptArgs), proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialer.(proxy.ContextDialer), nil
+}
+
+// socksAuth - The SOCKS5 username and password to connect to the local listener of the given transport with.
+//
+// @returns nil, if neither credentials nor PT arguments are needed.
+func (c *Controller) socksAuth(methodName, ptArgs string) *proxy.Auth {
+	if _, ok := c.listeners[methodName]; ok {
+		// Lyrebird and Snowflake receive PT arguments as SOCKS5 username and password.
+		if ptArgs != "" {
+			username, password := splitArgs(ptArgs)
+			return &proxy.Auth{User: username, Password: password}
+		}
+	} else if creds := c.credentials[methodName]; creds != nil {
+		return &proxy.Auth{User: creds.username, Password: creds.password}
+	}
+
+	return nil
+}
+
+// ServeHTTP - Handle HTTP CONNECT and plain HTTP forward requests.
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.creds != nil {
+		username, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+
+		if !ok || !p.creds.Valid(username, password) {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="IEnvoyProxy"`)
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+
+			return
+		}
+	}
+
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+	} else {
+		p.forward(w, r)
+	}
+}
+
+// connect - Tunnel a connection to the requested host.
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+
+	remote, err := p.dialer.DialContext(ctx, "tcp", r.Host)
+	if err != nil {
+		ptlog.Warnf("HTTP proxy for %s: Failed to connect to %s: %s", p.methodName, ptlog.ElideAddr(r.Host),
+			ptlog.ElideError(err))
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+
+		return
+	}
+
+	defer func(remote net.Conn) {
+		_ = remote.Close()
+	}(remote)
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+
+	// The client might already have sent data, which is now in the buffer.
+	copyLoop(&bufferedConn{conn, buf.Reader}, remote, done)
+
+	// Hijacked connections are not closed by the server, so close them ourselves on shutdown.
+	select {
+	case <-p.shutdown:
+	case <-done:
+	}
+}
+
+// forward - Forward a plain HTTP request.
+func (p *httpProxy) forward(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.IsAbs() || r.URL.Host == "" {
+		http.Error(w, "This is a proxy, requests need an absolute URL", http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+
+	res, err := p.transport.RoundTrip(out)
+	if err != nil {
+		ptlog.Warnf("HTTP proxy for %s: Failed to forward request to %s: %s", p.methodName,
+			ptlog.ElideAddr(r.URL.Host), ptlog.ElideError(err))
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+
+		return
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(res.Body)
+
+	removeHopHeaders(res.Header)
+
+	for key, values := range res.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	w.WriteHeader(res.StatusCode)
+
+	_, _ = io.Copy(w, res.Body)
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, field := range strings.Split(header.Get("Connection"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			header.Del(field)
+		}
+	}
+
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+}
+
+// parseProxyAuthorization - Parse HTTP Basic proxy authentication.
+func parseProxyAuthorization(value string) (username, password string, ok bool) {
+	// http.Request.BasicAuth only looks at the Authorization header.
+	r := &http.Request{Header: http.Header{"Authorization": {value}}}
+
+	return r.BasicAuth()
+}
+
+// bufferedConn - A connection, which first returns what was already buffered.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
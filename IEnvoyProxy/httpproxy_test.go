@@ -0,0 +1,182 @@
+package IEnvoyProxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// newTestHttpProxy - An HTTP proxy front-end, which dials directly instead of through a transport.
+func newTestHttpProxy(t *testing.T, creds *socksCredentials) *httptest.Server {
+	t.Helper()
+
+	p := &httpProxy{
+		methodName: "test",
+		dialer:     proxy.Direct,
+		transport:  &http.Transport{DialContext: proxy.Direct.DialContext},
+		creds:      creds,
+		shutdown:   make(chan struct{}),
+	}
+
+	server := httptest.NewServer(p)
+
+	t.Cleanup(func() {
+		close(p.shutdown)
+		server.Close()
+		p.transport.CloseIdleConnections()
+	})
+
+	return server
+}
+
+// echoServer - Echoes everything it receives on each TCP connection.
+func echoServer(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestHttpProxyConnect(t *testing.T) {
+	server := newTestHttpProxy(t, &socksCredentials{username: "user", password: "pass"})
+	target := echoServer(t)
+
+	connect := func(auth string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+		if auth != "" {
+			req += "Proxy-Authorization: " + auth + "\r\n"
+		}
+
+		if _, err = conn.Write([]byte(req + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		br := bufio.NewReader(conn)
+
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return conn, br, res
+	}
+
+	for _, auth := range []string{"", "Basic dXNlcjp3cm9uZw==", "Bearer dXNlcjpwYXNz"} {
+		_, _, res := connect(auth)
+
+		if res.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("auth %q: status = %d, want %d", auth, res.StatusCode, http.StatusProxyAuthRequired)
+		}
+
+		if res.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("auth %q: missing Proxy-Authenticate", auth)
+		}
+	}
+
+	// "user:pass"
+	conn, br, res := connect("Basic dXNlcjpwYXNz")
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("tunnel read %q, %v, want %q", buf, err, "ping")
+	}
+}
+
+func TestHttpProxyForward(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range []string{"Proxy-Authorization", "Proxy-Connection", "X-Hop"} {
+			if r.Header.Get(key) != "" {
+				t.Errorf("backend received hop-by-hop header %s", key)
+			}
+		}
+
+		w.Header().Set("Connection", "X-Secret")
+		w.Header().Set("X-Secret", "hop")
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	server := newTestHttpProxy(t, &socksCredentials{username: "user", password: "pass"})
+
+	proxyUrl, _ := url.Parse(server.URL)
+	proxyUrl.User = url.UserPassword("user", "pass")
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("response = %d %q, want 200 %q", res.StatusCode, body, "hello")
+	}
+
+	if res.Header.Get("X-Secret") != "" {
+		t.Error("hop-by-hop header X-Secret was forwarded to the client")
+	}
+
+	// Origin-form requests are no proxy requests.
+	res, err = http.Get(newTestHttpProxy(t, nil).URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("origin-form status = %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,137 @@
+package IEnvoyProxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Log rotation defaults, see `SetLogRotation`.
+const (
+	defaultLogMaxSize = 5 * 1024 * 1024
+	defaultLogBackups = 2
+)
+
+// logFile - A log file, which is rotated, when it grows beyond its maximum size.
+//
+// The backups are named like the file with a number appended, ".1" being the most recent.
+type logFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	// file - nil, if logging to the file is disabled.
+	file *os.File
+	size int64
+}
+
+// open - Open the file for appending.
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+// close - Close the file, if open.
+func (f *logFile) close() {
+	if f.file != nil {
+		_ = f.file.Close()
+		f.file = nil
+	}
+}
+
+// write - Append a line and rotate, if the file is too big now.
+func (f *logFile) write(line string) {
+	if f.file == nil {
+		return
+	}
+
+	n, _ := f.file.WriteString(line)
+	f.size += int64(n)
+
+	f.rotateIfNeeded()
+}
+
+// rotateIfNeeded - Rotate, if the file is bigger than allowed.
+func (f *logFile) rotateIfNeeded() {
+	if f.file == nil || f.maxSize <= 0 || f.size < f.maxSize {
+		return
+	}
+
+	f.close()
+
+	// Keep appending, if the file couldn't be moved, rather than losing the log.
+	_ = f.shift()
+	_ = f.open()
+}
+
+// shift - Move the closed file to the first backup and shift the other backups.
+func (f *logFile) shift() error {
+	// Also removes backups from a bigger number configured before.
+	for i := f.backups + 1; os.Remove(backupLogPath(f.path, i)) == nil; i++ {
+	}
+
+	for i := f.backups - 1; i >= 1; i-- {
+		err := os.Rename(backupLogPath(f.path, i), backupLogPath(f.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	var err error
+
+	if f.backups > 0 {
+		err = os.Rename(f.path, backupLogPath(f.path, 1))
+	} else {
+		err = os.Remove(f.path)
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// read - The content of the backups, oldest first, and the file.
+func (f *logFile) read() (string, error) {
+	var content strings.Builder
+
+	for i := f.backups; i >= 0; i-- {
+		path := f.path
+		if i > 0 {
+			path = backupLogPath(f.path, i)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return "", err
+		}
+
+		content.Write(data)
+	}
+
+	return content.String(), nil
+}
+
+// backupLogPath - The path of the nth backup of a log file.
+func backupLogPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
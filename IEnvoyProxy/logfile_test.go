@@ -0,0 +1,123 @@
+package IEnvoyProxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LogFileName)
+	f := &logFile{path: path, maxSize: 20, backups: 2}
+
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.close()
+
+	// Each line is 10 bytes, so every second one rotates.
+	for i := 1; i <= 7; i++ {
+		f.write(fmt.Sprintf("line %04d\n", i))
+	}
+
+	want := map[string]string{
+		path:                   "line 0007\n",
+		backupLogPath(path, 1): "line 0005\nline 0006\n",
+		backupLogPath(path, 2): "line 0003\nline 0004\n",
+	}
+
+	for p, content := range want {
+		if got := readFile(t, p); got != content {
+			t.Errorf("%s = %q, want %q", filepath.Base(p), got, content)
+		}
+	}
+
+	if _, err := os.Stat(backupLogPath(path, 3)); !os.IsNotExist(err) {
+		t.Errorf("third backup kept: %v", err)
+	}
+
+	if got, _ := f.read(); got != "line 0003\nline 0004\nline 0005\nline 0006\nline 0007\n" {
+		t.Errorf("read() = %q", got)
+	}
+}
+
+func TestLogFilePruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, LogFileName)
+
+	for i := 1; i <= 3; i++ {
+		writeFile(t, backupLogPath(path, i), fmt.Sprintf("backup %d\n", i))
+	}
+
+	c := NewController(dir, true, false, "ERROR", nil)
+	logRouter.dispatch("ERROR", "", "prune-first")
+
+	// Fewer backups and a size the current file exceeds.
+	c.SetLogRotation(10, 1)
+
+	if got := readFile(t, backupLogPath(path, 1)); !strings.Contains(got, "prune-first") {
+		t.Errorf("first backup = %q, want the rotated file", got)
+	}
+
+	for i := 2; i <= 3; i++ {
+		if _, err := os.Stat(backupLogPath(path, i)); !os.IsNotExist(err) {
+			t.Errorf("backup %d not pruned: %v", i, err)
+		}
+	}
+
+	// No backups at all.
+	c.SetLogRotation(1000, 0)
+	logRouter.dispatch("ERROR", "", "prune-second")
+	c.SetLogRotation(10, 0)
+
+	if _, err := os.Stat(backupLogPath(path, 1)); !os.IsNotExist(err) {
+		t.Errorf("backup kept with 0 backups: %v", err)
+	}
+
+	if got := readFile(t, path); got != "" {
+		t.Errorf("log file after rotation without backups = %q", got)
+	}
+}
+
+func TestExportLogs(t *testing.T) {
+	dir := t.TempDir()
+	c := NewController(dir, true, true, "ERROR", nil)
+	c.SetLogRotation(200, 3)
+
+	for i := 1; i <= 6; i++ {
+		logRouter.dispatch("ERROR", "", fmt.Sprintf("export-%d from 192.0.2.%d:443", i, i))
+	}
+
+	// Unsafe logging keeps addresses in the log file itself.
+	if !strings.Contains(readFile(t, filepath.Join(dir, LogFileName)), "192.0.2.6:443") {
+		t.Error("unsafe log file scrubbed")
+	}
+
+	if _, err := os.Stat(backupLogPath(filepath.Join(dir, LogFileName), 1)); err != nil {
+		t.Fatalf("log not rotated: %v", err)
+	}
+
+	logs, err := c.ExportLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+
+	for _, line := range strings.Split(logs, "\n") {
+		if _, rest, ok := strings.Cut(line, "export-"); ok {
+			order = append(order, rest[:1])
+		}
+	}
+
+	if strings.Join(order, "") != "123456" {
+		t.Errorf("exported messages in order %v, want oldest first", order)
+	}
+
+	if strings.Contains(logs, "192.0.2.") {
+		t.Errorf("exported logs not scrubbed:\n%s", logs)
+	}
+}
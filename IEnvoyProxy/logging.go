@@ -0,0 +1,544 @@
+package IEnvoyProxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"weak"
+
+	hysteria2 "github.com/apernet/hysteria/app/v2/cmd"
+	v2ray "github.com/v2fly/v2ray-core/v5/envoy"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// OnLogMessage - Interface to receive log messages, e.g. to forward them to Logcat or OSLog.
+type OnLogMessage interface {
+	// LogMessage - Called for each message within the log level.
+	//
+	// @param level NOTICE, ERROR, WARN, INFO or DEBUG.
+	//
+	// @param transport The `methodName` of the transport which logged the message, "v2ray" for all V2Ray
+	// transports, "lyrebird" for code Lyrebird's transports share, or empty for IEnvoyProxy itself.
+	//
+	// @param message The message, with addresses and credentials scrubbed, unless unsafe logging is enabled.
+	LogMessage(level, transport, message string)
+}
+
+// SetOnLogMessage - Set a delegate to receive log messages, additionally to the log file. Works also, if logging to
+// the file is disabled.
+//
+// The transports log process-wide, so the delegate receives the messages of all Controllers' transports. They are
+// filtered by this Controller's log level and scrubbed like the log file.
+//
+// @param delegate The delegate, or nil to remove it. Will be called on the thread which logs! Needs to return
+// quickly and must not call back into the Controller.
+func (c *Controller) SetOnLogMessage(delegate OnLogMessage) {
+	c.logSink.mutex.Lock()
+	c.logSink.delegate = delegate
+	c.logSink.mutex.Unlock()
+
+	logRouter.refresh()
+}
+
+// SetLogLevel - Change the log level of this Controller's log file and delegate, e.g. to DEBUG while investigating
+// a problem. Applies right away, also to running transports.
+//
+// @param level ERROR, WARN, INFO or DEBUG.
+//
+// @throws if the level is invalid. The level is unchanged then.
+func (c *Controller) SetLogLevel(level string) error {
+	value, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+
+	c.logSink.level.Store(int32(value))
+
+	logRouter.refresh()
+
+	return nil
+}
+
+// SetLogRotation - Configure rotation of the log file. The current file is moved to a backup, when it grows beyond
+// the maximum size. Defaults to 5 MiB and 2 backups.
+//
+// @param maxSize Maximum size of the log file in bytes. 0 or less to never rotate.
+//
+// @param backups How many rotated files to keep, named like the log file with ".1", ".2", etc. appended.
+// 0 or less to just start over.
+func (c *Controller) SetLogRotation(maxSize, backups int) {
+	c.logSink.mutex.Lock()
+	defer c.logSink.mutex.Unlock()
+
+	c.logSink.file.maxSize = int64(maxSize)
+	c.logSink.file.backups = max(0, backups)
+
+	c.logSink.file.rotateIfNeeded()
+}
+
+// ExportLogs - A copy of the log file and its backups for support tickets, oldest first.
+//
+// Addresses and credentials are scrubbed, even if unsafe logging is enabled.
+//
+// @throws if a log file cannot be read.
+func (c *Controller) ExportLogs() (string, error) {
+	c.logSink.mutex.Lock()
+	content, err := c.logSink.file.read()
+	c.logSink.mutex.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	return scrub(content), nil
+}
+
+// Log levels, in the order of verbosity. NOTICE is always logged, like with Lyrebird.
+const (
+	logLevelNotice = iota
+	logLevelError
+	logLevelWarn
+	logLevelInfo
+	logLevelDebug
+)
+
+var logLevelNames = []string{"NOTICE", "ERROR", "WARN", "INFO", "DEBUG"}
+
+// parseLogLevel - Parse a log level name.
+//
+// @throws if the name is none of ERROR, WARN, INFO or DEBUG.
+func parseLogLevel(name string) (int, error) {
+	for level, levelName := range logLevelNames {
+		if level != logLevelNotice && strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+
+	return logLevelError, fmt.Errorf("invalid log level %q, use ERROR, WARN, INFO or DEBUG", name)
+}
+
+// Log sources, besides the `methodName` constants.
+const (
+	logSourceV2Ray    = "v2ray"
+	logSourceLyrebird = "lyrebird"
+)
+
+const (
+	lyrebirdModule  = "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/"
+	snowflakeModule = "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/"
+	ptlogPackage    = lyrebirdModule + "common/log"
+)
+
+// logSink - Where one Controller writes the process-wide log to.
+type logSink struct {
+	level  atomic.Int32
+	unsafe bool
+
+	// file, delegate - Guarded by mutex.
+	file     *logFile
+	delegate OnLogMessage
+	mutex    sync.Mutex
+}
+
+// newLogSink - Create a sink and register it with the `logRouter`.
+//
+// @param enable Append to the file at path. Otherwise, only a delegate set with `SetOnLogMessage` gets messages.
+//
+// @param unsafe Disable the scrubber, see `scrub`.
+//
+// @throws if the log file cannot be opened.
+func newLogSink(enable bool, path string, unsafe bool, level int) (*logSink, error) {
+	s := &logSink{
+		unsafe: unsafe,
+		file:   &logFile{path: path, maxSize: defaultLogMaxSize, backups: defaultLogBackups},
+	}
+	s.level.Store(int32(level))
+
+	if enable {
+		if err := s.file.open(); err != nil {
+			return nil, err
+		}
+
+		// The sink is dropped together with its Controller, as there is no way to destroy one explicitly.
+		runtime.AddCleanup(s, func(file *logFile) { file.close() }, s.file)
+	}
+
+	logRouter.add(s)
+
+	return s, nil
+}
+
+// enabled - Whether the sink writes anywhere.
+func (s *logSink) enabled() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.file.file != nil || s.delegate != nil
+}
+
+// write - Write a message, if its level is within the sink's level.
+//
+// @param transport See `OnLogMessage`.
+func (s *logSink) write(level int, transport, message string) {
+	if level > int(s.level.Load()) {
+		return
+	}
+
+	if !s.unsafe {
+		message = scrub(message)
+	}
+
+	if transport != "" {
+		transport += ": "
+	}
+
+	line := fmt.Sprintf("%s [%s]: %s%s\n", time.Now().Format("2006/01/02 15:04:05"), logLevelNames[level],
+		transport, message)
+
+	s.mutex.Lock()
+
+	s.file.write(line)
+
+	delegate := s.delegate
+
+	s.mutex.Unlock()
+
+	if delegate != nil {
+		delegate.LogMessage(logLevelNames[level], strings.TrimSuffix(transport, ": "), message)
+	}
+}
+
+// logRouter - Lyrebird, Snowflake, V2Ray and Hysteria2 each log process-wide, without telling which Controller
+// started the transport. This collects all of it and hands it to the sinks of all Controllers, which each apply
+// their own level.
+//
+// Lyrebird and Snowflake log through Go's standard logger, so the router takes it over, as long as any Controller
+// exists, and restores it, when the last one is gone. Messages of the app itself are passed through to its original
+// output meanwhile.
+var logRouter = &router{}
+
+type router struct {
+	sinks []weak.Pointer[logSink]
+	mutex sync.Mutex
+
+	// hookOnce - Hook up V2Ray and Hysteria2 on first use. They drop their messages, when there are no sinks.
+	hookOnce sync.Once
+
+	// installed - Whether the router owns Go's standard logger.
+	installed bool
+
+	// std - Go's standard logger, as it was before the router took it over, to pass the app's messages through.
+	std atomic.Pointer[log.Logger]
+
+	// level - The level of the most verbose enabled sink, -1 if none is enabled.
+	level atomic.Int32
+
+	// ptLevel - The level Lyrebird was last set to.
+	ptLevel string
+}
+
+// add - Register a sink.
+func (r *router) add(s *logSink) {
+	r.hookOnce.Do(func() {
+		v2ray.SetLogger(func(level, message string) {
+			r.dispatch(level, logSourceV2Ray, message)
+		})
+
+		hysteria2.LogFunc = func(level, message string) {
+			r.dispatch(level, Hysteria2, message)
+		}
+	})
+
+	// Update, when the sink's Controller is gone, to release the standard logger after the last one.
+	runtime.AddCleanup(s, func(r *router) { r.refresh() }, r)
+
+	r.mutex.Lock()
+	r.sinks = append(r.sinks, weak.Make(s))
+	err := r.update()
+	r.mutex.Unlock()
+
+	// Not while holding the mutex, as the message comes back through the router.
+	if err != nil {
+		log.Printf("Failed to initialize log: %s", err)
+	}
+}
+
+// refresh - Apply changed sink settings.
+func (r *router) refresh() {
+	r.mutex.Lock()
+	err := r.update()
+	r.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("Failed to initialize log: %s", err)
+	}
+}
+
+// update - Let all transports log what the most verbose sink wants, so they don't produce messages nobody wants.
+//
+// Prunes sinks of Controllers which are gone and releases the standard logger after the last one.
+//
+// Needs to be called with the mutex held.
+//
+// @throws if Lyrebird's logger cannot be initialized.
+func (r *router) update() error {
+	enabled := false
+	level := logLevelError
+
+	sinks := r.sinks[:0]
+
+	for _, pointer := range r.sinks {
+		s := pointer.Value()
+		if s == nil {
+			continue
+		}
+
+		sinks = append(sinks, pointer)
+
+		if s.enabled() {
+			enabled = true
+			level = max(level, int(s.level.Load()))
+		}
+	}
+
+	r.sinks = sinks
+
+	if len(r.sinks) < 1 {
+		r.uninstall()
+
+		return nil
+	}
+
+	if err := r.install(); err != nil {
+		return err
+	}
+
+	if enabled {
+		r.level.Store(int32(level))
+	} else {
+		r.level.Store(-1)
+	}
+
+	// Lyrebird reads its level without synchronization, so only write it, when it really changes.
+	if r.ptLevel != logLevelNames[level] {
+		_ = ptlog.SetLogLevel(logLevelNames[level])
+		r.ptLevel = logLevelNames[level]
+	}
+
+	v2ray.SetLogLevel(logLevelNames[level])
+	hysteria2.SetLogLevel(logLevelNames[level])
+
+	return nil
+}
+
+// install - Take over Go's standard logger and let Lyrebird log to it, unless done already.
+//
+// Lyrebird is told to log unsafely, as each sink scrubs on its own, see `logSink.write`.
+//
+// Needs to be called with the mutex held.
+//
+// @throws if Lyrebird's logger cannot be initialized.
+func (r *router) install() error {
+	if r.installed {
+		return nil
+	}
+
+	std := log.New(log.Writer(), log.Prefix(), log.Flags())
+
+	// Lyrebird only knows log files, so let it open /dev/null and replace that right away.
+	if err := ptlog.Init(true, os.DevNull, true); err != nil {
+		return err
+	}
+
+	devNull := log.Writer()
+
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(r)
+
+	if closer, ok := devNull.(io.Closer); ok {
+		_ = closer.Close()
+	}
+
+	r.std.Store(std)
+	r.installed = true
+
+	return nil
+}
+
+// uninstall - Silence Lyrebird and give Go's standard logger back, unless done already.
+//
+// Needs to be called with the mutex held.
+func (r *router) uninstall() {
+	if !r.installed {
+		return
+	}
+
+	// Doesn't open a file, when disabled.
+	_ = ptlog.Init(false, "", false)
+
+	std := r.std.Swap(nil)
+
+	log.SetOutput(std.Writer())
+	log.SetFlags(std.Flags())
+	log.SetPrefix(std.Prefix())
+
+	r.installed = false
+	r.level.Store(-1)
+}
+
+// Write - Implements `io.Writer` for Go's standard logger, which Lyrebird and Snowflake use.
+//
+// Lyrebird prefixes messages with their level, Snowflake doesn't. These are treated as INFO.
+//
+// The transport is determined from the call stack. Messages of the app itself go to the standard logger's original
+// output.
+func (r *router) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+
+	transport, ok := logSource()
+	if !ok {
+		// Frames up to the app: Output, Write, log.(*Logger).output, log.Printf or the like.
+		if std := r.std.Load(); std != nil {
+			_ = std.Output(4, message)
+		}
+
+		return len(p), nil
+	}
+
+	// No sink is enabled.
+	if r.level.Load() < 0 {
+		return len(p), nil
+	}
+
+	level := logLevelNames[logLevelInfo]
+
+	// Snowflake logs empty lines as separators.
+	if strings.TrimSpace(message) == "" {
+		return len(p), nil
+	}
+
+	if strings.HasPrefix(message, "[") {
+		if name, rest, ok := strings.Cut(message[1:], "]: "); ok && !strings.ContainsAny(name, " ]") {
+			level, message = name, rest
+		}
+	}
+
+	if value, err := parseLogLevel(level); err == nil && value > int(r.level.Load()) {
+		return len(p), nil
+	}
+
+	r.dispatch(level, transport, message)
+
+	return len(p), nil
+}
+
+// logSource - The transport, which logged through Go's standard logger, see `OnLogMessage`.
+//
+// @returns false, if the app itself logged, i.e. neither a transport nor IEnvoyProxy through Lyrebird's logger.
+func logSource() (string, bool) {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	viaPtlog := false
+
+	for {
+		frame, more := frames.Next()
+
+		viaPtlog = viaPtlog || strings.HasPrefix(frame.Function, ptlogPackage+".")
+
+		// Skip the loggers.
+		if !strings.HasPrefix(frame.Function, "log.") && !strings.HasPrefix(frame.Function, ptlogPackage+".") {
+			// Function names look like "example.com/path/package.(*Type).Method".
+			pkg := frame.Function
+			slash := strings.LastIndex(pkg, "/")
+
+			if dot := strings.Index(pkg[slash+1:], "."); dot >= 0 {
+				pkg = pkg[:slash+1+dot]
+			}
+
+			switch {
+			case strings.HasPrefix(pkg, lyrebirdModule+"transports/"):
+				switch name := strings.TrimPrefix(pkg, lyrebirdModule+"transports/"); name {
+				case "meeklite":
+					return MeekLite, true
+
+				case "base":
+					return logSourceLyrebird, true
+
+				default:
+					return name, true
+				}
+
+			case strings.HasPrefix(pkg, lyrebirdModule):
+				return logSourceLyrebird, true
+
+			case strings.HasPrefix(pkg, snowflakeModule):
+				return Snowflake, true
+
+			default:
+				return "", viaPtlog
+			}
+		}
+
+		if !more {
+			return "", viaPtlog
+		}
+	}
+}
+
+// newTransportLogger - A logger for transports, which take one instead of logging process-wide, like TubeSocks.
+// Hands their messages to the router, attributed to the given transport.
+//
+// Messages prefixed with "[ERR] " are treated as ERROR, all others as INFO.
+func newTransportLogger(transport string) *log.Logger {
+	return log.New(transportLogWriter(transport), "", 0)
+}
+
+// transportLogWriter - Implements `io.Writer` for `newTransportLogger`. The transport's `methodName`.
+type transportLogWriter string
+
+func (w transportLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+	level := logLevelNames[logLevelInfo]
+
+	if rest, ok := strings.CutPrefix(message, "[ERR] "); ok {
+		level, message = logLevelNames[logLevelError], rest
+	}
+
+	logRouter.dispatch(level, string(w), message)
+
+	return len(p), nil
+}
+
+// dispatch - Hand a message to all sinks.
+//
+// @param levelName NOTICE, ERROR, WARN, INFO or DEBUG. Unknown levels are treated as ERROR.
+//
+// @param transport See `OnLogMessage`.
+func (r *router) dispatch(levelName, transport, message string) {
+	level, err := parseLogLevel(levelName)
+	if err != nil && strings.EqualFold(levelName, logLevelNames[logLevelNotice]) {
+		level = logLevelNotice
+	}
+
+	r.mutex.Lock()
+	sinks := make([]*logSink, 0, len(r.sinks))
+
+	for _, pointer := range r.sinks {
+		if s := pointer.Value(); s != nil {
+			sinks = append(sinks, s)
+		}
+	}
+
+	r.mutex.Unlock()
+
+	for _, s := range sinks {
+		s.write(level, transport, message)
+	}
+}
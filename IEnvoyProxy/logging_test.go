@@ -0,0 +1,293 @@
+package IEnvoyProxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	hysteria2 "github.com/apernet/hysteria/app/v2/cmd"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// logRecorder - Records the messages passed to an `OnLogMessage` delegate.
+type logRecorder struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (r *logRecorder) LogMessage(level, transport, message string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.messages = append(r.messages, fmt.Sprintf("%s|%s|%s", level, transport, message))
+}
+
+// take - The recorded messages containing marker, to ignore what other tests log meanwhile.
+func (r *logRecorder) take(marker string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var messages []string
+
+	for _, message := range r.messages {
+		if strings.Contains(message, marker) {
+			messages = append(messages, message)
+		}
+	}
+
+	r.messages = nil
+
+	return messages
+}
+
+func (r *logRecorder) contains(substring string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, message := range r.messages {
+		if strings.Contains(message, substring) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestLogDelegateLevels(t *testing.T) {
+	tests := []struct {
+		level string
+		want  []string
+	}{
+		{level: "ERROR", want: []string{"NOTICE", "ERROR"}},
+		{level: "WARN", want: []string{"NOTICE", "ERROR", "WARN"}},
+		{level: "INFO", want: []string{"NOTICE", "ERROR", "WARN", "INFO"}},
+		{level: "DEBUG", want: []string{"NOTICE", "ERROR", "WARN", "INFO", "DEBUG"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			marker := "levels-" + tt.level
+
+			c := NewController(t.TempDir(), false, false, tt.level, nil)
+			rec := &logRecorder{}
+			c.SetOnLogMessage(rec)
+
+			for _, level := range []string{"NOTICE", "ERROR", "WARN", "INFO", "DEBUG"} {
+				logRouter.dispatch(level, Hysteria2, marker)
+			}
+
+			var levels []string
+
+			for _, message := range rec.take(marker) {
+				levels = append(levels, strings.Split(message, "|")[0])
+			}
+
+			if strings.Join(levels, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("delegate got %v, want %v", levels, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogDelegate(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "WARN", nil)
+	rec := &logRecorder{}
+	c.SetOnLogMessage(rec)
+
+	ptlog.Warnf("delegate-lyrebird connecting to 192.0.2.1:443")
+	ptlog.Infof("delegate-lyrebird too verbose")
+	logRouter.dispatch("Warning", logSourceV2Ray, "delegate-v2ray unknown level")
+
+	want := []string{
+		"WARN||delegate-lyrebird connecting to [scrubbed]",
+		"ERROR|v2ray|delegate-v2ray unknown level",
+	}
+
+	if got := rec.take("delegate-"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("delegate got %q, want %q", got, want)
+	}
+
+	c.SetOnLogMessage(nil)
+	ptlog.Warnf("delegate-removed")
+
+	if got := rec.take("delegate-"); len(got) != 0 {
+		t.Errorf("removed delegate got %q", got)
+	}
+}
+
+func TestLogDelegateUnsafe(t *testing.T) {
+	c := NewController(t.TempDir(), false, true, "ERROR", nil)
+	rec := &logRecorder{}
+	c.SetOnLogMessage(rec)
+
+	logRouter.dispatch("ERROR", Hysteria2, "unsafe-delegate 192.0.2.1:443")
+
+	if got := rec.take("unsafe-delegate"); len(got) != 1 || got[0] != "ERROR|hysteria2|unsafe-delegate 192.0.2.1:443" {
+		t.Errorf("unsafe delegate got %q", got)
+	}
+}
+
+func TestLogRouting(t *testing.T) {
+	fileDir := t.TempDir()
+	withFile := NewController(fileDir, true, false, "ERROR", nil)
+
+	withDelegate := NewController(t.TempDir(), false, false, "DEBUG", nil)
+	rec := &logRecorder{}
+	withDelegate.SetOnLogMessage(rec)
+	defer withDelegate.SetOnLogMessage(nil)
+
+	ptlog.Errorf("failed to connect to %s", "192.0.2.7:443")
+	ptlog.Debugf("debug message")
+	log.Printf("app message")
+	hysteria2.LogFunc("WARN", "hysteria message")
+
+	for _, want := range []string{"ERROR||failed to connect to [scrubbed]", "DEBUG||debug message",
+		"WARN|hysteria2|hysteria message"} {
+
+		if !rec.contains(want) {
+			t.Errorf("delegate didn't get %q, got %q", want, rec.messages)
+		}
+	}
+
+	if rec.contains("192.0.2.7") {
+		t.Error("delegate got an unscrubbed address")
+	}
+
+	// It's the app's own, not a transport's.
+	if rec.contains("app message") {
+		t.Error("delegate got the app's message")
+	}
+
+	content, err := os.ReadFile(filepath.Join(fileDir, LogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(content, []byte("[ERROR]: failed to connect to [scrubbed]")) {
+		t.Errorf("log file misses the error:\n%s", content)
+	}
+
+	if bytes.Contains(content, []byte("debug message")) || bytes.Contains(content, []byte("hysteria message")) {
+		t.Errorf("log file has messages beyond its level:\n%s", content)
+	}
+
+	runtime.KeepAlive(withFile)
+}
+
+func TestTransportLogger(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "INFO", nil)
+	rec := &logRecorder{}
+	c.SetOnLogMessage(rec)
+	defer c.SetOnLogMessage(nil)
+
+	logger := newTransportLogger(Obfs4TubeSocks)
+	logger.Printf("[ERR] socks: Failed to handle request from %s", "192.0.2.7:1234")
+	logger.Printf("socks: other message")
+
+	for _, want := range []string{"ERROR|obfs4_tubesocks|socks: Failed to handle request from [scrubbed]",
+		"INFO|obfs4_tubesocks|socks: other message"} {
+
+		if !rec.contains(want) {
+			t.Errorf("delegate didn't get %q, got %q", want, rec.messages)
+		}
+	}
+}
+
+func TestLogRouterDoesNotLeakFiles(t *testing.T) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("can't count open files:", err)
+	}
+
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	rec := &logRecorder{}
+
+	before := len(fds)
+
+	for range 50 {
+		c.SetOnLogMessage(rec)
+		c.SetOnLogMessage(nil)
+	}
+
+	fds, _ = os.ReadDir("/proc/self/fd")
+
+	if len(fds) > before+2 {
+		t.Errorf("%d files open after toggling logging, %d before", len(fds), before)
+	}
+}
+
+func TestLogRouterRestoresStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Let the Controllers of other tests go first.
+	for i := 0; i < 50 && logRouter.owned(); i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if logRouter.owned() {
+		t.Skip("Controllers of other tests are still alive")
+	}
+
+	output, flags, prefix := log.Writer(), log.Flags(), log.Prefix()
+
+	log.SetOutput(&buf)
+	log.SetFlags(log.Lshortfile)
+	log.SetPrefix("app: ")
+
+	defer func() {
+		log.SetOutput(output)
+		log.SetFlags(flags)
+		log.SetPrefix(prefix)
+	}()
+
+	func() {
+		c := NewController(t.TempDir(), false, false, "ERROR", nil)
+		c.SetOnLogMessage(&logRecorder{})
+
+		if log.Writer() != logRouter {
+			t.Error("router didn't take over the standard logger")
+		}
+
+		log.Printf("while taken over")
+
+		// The app's messages pass through, Lyrebird's and IEnvoyProxy's don't.
+		ptlog.Noticef("from IEnvoyProxy")
+
+		if want := "app: logging_test.go:"; !strings.HasPrefix(buf.String(), want) ||
+			!strings.HasSuffix(buf.String(), ": while taken over\n") {
+
+			t.Errorf("standard logger output = %q, want %q...", buf.String(), want)
+		}
+	}()
+
+	for i := 0; i < 100 && logRouter.owned(); i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if log.Writer() != &buf || log.Flags() != log.Lshortfile || log.Prefix() != "app: " {
+		t.Fatal("standard logger not restored after the last Controller is gone")
+	}
+
+	log.Printf("after restore")
+
+	if strings.Contains(buf.String(), "from IEnvoyProxy") || !strings.Contains(buf.String(), "after restore") {
+		t.Errorf("standard logger output = %q", buf.String())
+	}
+}
+
+// owned - Whether the router currently owns Go's standard logger.
+func (r *router) owned() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.installed
+}
@@ -0,0 +1,116 @@
+package IEnvoyProxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	v2ray "github.com/v2fly/v2ray-core/v5/envoy"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// PinDomainIPs - Connect to the given IP addresses instead of resolving a domain, e.g. to work around DNS poisoning.
+//
+// The domain is still used for TLS (SNI and certificate verification) and the HTTP Host header.
+// The addresses are tried in turn: When a connection to one fails, the next one is tried and used first
+// from then on.
+//
+// Honored by all transports. Snowflake resolves its broker, front and ICE server domains with the system resolver,
+// so it refuses to start, if one of them is pinned. Pins are process-wide, so they are shared by all `Controller`s.
+// Takes effect with the next connection, no restart needed, except for Hysteria2 and Snowflake, which check them
+// on start. Hysteria2 switches to the next address, when the current one doesn't answer, unless port hopping is
+// used.
+//
+// @param domain The domain to pin, e.g. the one in `V2RayServerAddress`. Case and a trailing dot don't matter.
+//
+// @param commaSeparatedIPs A comma-separated list of IPv4 and/or IPv6 addresses.
+//
+// @throws if the domain is empty or the list contains anything else than IP addresses.
+func (c *Controller) PinDomainIPs(domain, commaSeparatedIPs string) error {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return fmt.Errorf("no domain to pin")
+	}
+
+	var ips []string
+
+	for _, ip := range strings.Split(commaSeparatedIPs, ",") {
+		ip = strings.TrimSpace(ip)
+		if ip == "" {
+			continue
+		}
+
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("not an IP address: %q", ip)
+		}
+
+		ips = append(ips, ip)
+	}
+
+	if len(ips) < 1 {
+		return fmt.Errorf("no IP addresses to pin %s to", domain)
+	}
+
+	v2ray.PinDomainIPs(domain, ips)
+	sharedResolver.pin(domain, ips)
+
+	ptlog.Noticef("Pinned %s to %d IP address(es)", ptlog.ElideAddr(domain), len(ips))
+
+	return nil
+}
+
+// UnpinDomain - Resolve the given domain normally again.
+//
+// @param domain A domain previously given to `PinDomainIPs`.
+func (c *Controller) UnpinDomain(domain string) {
+	domain = normalizeDomain(domain)
+
+	v2ray.UnpinDomain(domain)
+	sharedResolver.unpin(domain)
+
+	ptlog.Noticef("Unpinned %s", ptlog.ElideAddr(domain))
+}
+
+// startHysteria2PinnedRelay - Relay Hysteria2's QUIC traffic to the IP addresses its server is pinned to, as it
+// resolves the server only once and would stick to the first address.
+//
+// The original host is kept as TLS server name, unless `Hysteria2Server` already sets one.
+//
+// @returns the `Hysteria2Server` URL rewritten to point to the relay, or unchanged, if its server isn't pinned to
+// more than one IP address or uses port hopping, which the relay doesn't support.
+//
+// @throws if the relay cannot be set up.
+func (c *Controller) startHysteria2PinnedRelay() (string, error) {
+	server, err := url.Parse(c.Hysteria2Server)
+	if err != nil || server.Hostname() == "" || len(sharedResolver.pinned(server.Hostname())) < 2 {
+		return c.Hysteria2Server, nil
+	}
+
+	port := server.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	remote, err := sharedResolver.newPinnedConn(server.Hostname(), port)
+	if err != nil {
+		return "", err
+	}
+
+	relay, err := newUdpRelay(remote)
+	if err != nil {
+		return "", err
+	}
+
+	query := server.Query()
+	if query.Get("sni") == "" {
+		query.Set("sni", server.Hostname())
+	}
+
+	server.Host = relay.addr()
+	server.RawQuery = query.Encode()
+
+	c.hysteria2Relay = relay
+
+	return server.String(), nil
+}
@@ -0,0 +1,108 @@
+package IEnvoyProxy
+
+import (
+	"slices"
+	"testing"
+
+	core "github.com/v2fly/v2ray-core/v5"
+)
+
+func TestPinDomainIPs(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+
+	if err := c.PinDomainIPs(" Pinned.Example. ", "192.0.2.1, 2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"192.0.2.1", "2001:db8::1"}
+
+	// Whichever spelling transports use, V2Ray and everybody else find the same pins.
+	for _, domain := range []string{"pinned.example", "PINNED.example", "pinned.example."} {
+		if ips := sharedResolver.pinned(domain); !slices.Equal(ips, want) {
+			t.Errorf("pinned(%q) = %v, want %v", domain, ips, want)
+		}
+
+		if ips, _ := core.GetDomainIPs(domain); !slices.Equal(ips, want) {
+			t.Errorf("V2Ray GetDomainIPs(%q) = %v, want %v", domain, ips, want)
+		}
+	}
+
+	c.UnpinDomain("PINNED.EXAMPLE.")
+
+	if ips := sharedResolver.pinned("pinned.example"); len(ips) > 0 {
+		t.Errorf("pinned() = %v after UnpinDomain", ips)
+	}
+
+	if ips, ok := core.GetDomainIPs("pinned.example"); ok {
+		t.Errorf("V2Ray GetDomainIPs() = %v after UnpinDomain", ips)
+	}
+}
+
+func TestPinDomainIPsErrors(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+
+	tests := []struct {
+		name   string
+		domain string
+		ips    string
+	}{
+		{"no domain", " . ", "192.0.2.1"},
+		{"not an IP address", "pinned.example", "192.0.2.1,example.com"},
+		{"no IP addresses", "pinned.example", " , "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.PinDomainIPs(tt.domain, tt.ips); err == nil {
+				t.Error("PinDomainIPs() succeeded, want error")
+			}
+		})
+	}
+
+	if ips := sharedResolver.pinned("pinned.example"); len(ips) > 0 {
+		t.Errorf("pinned() = %v after failed PinDomainIPs", ips)
+	}
+}
+
+func TestHysteria2PinnedRelay(t *testing.T) {
+	sharedResolver.pin("multi.example", []string{"192.0.2.1", "192.0.2.2"})
+	sharedResolver.pin("single.example", []string{"192.0.2.1"})
+
+	defer sharedResolver.unpin("multi.example")
+	defer sharedResolver.unpin("single.example")
+
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+
+	// Nothing to rotate, or port hopping, which the relay can't do: resolveServer takes care of these.
+	for _, server := range []string{"hysteria2://auth@single.example:443", "hysteria2://auth@multi.example:1000-2000",
+		"hysteria2://auth@other.example:443"} {
+
+		c.Hysteria2Server = server
+
+		if got, err := c.startHysteria2PinnedRelay(); err != nil || got != server || c.hysteria2Relay != nil {
+			t.Errorf("startHysteria2PinnedRelay() with %s = %q, %v, want unchanged", server, got, err)
+		}
+	}
+
+	c.Hysteria2Server = "hysteria2://auth@multi.example:8443/?insecure=1"
+
+	got, err := c.startHysteria2PinnedRelay()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.hysteria2Relay == nil {
+		t.Fatal("no relay started")
+	}
+
+	defer c.hysteria2Relay.close()
+
+	want := "hysteria2://auth@" + c.hysteria2Relay.addr() + "/?insecure=1&sni=multi.example"
+	if got != want {
+		t.Errorf("startHysteria2PinnedRelay() = %q, want %q", got, want)
+	}
+
+	if remote, ok := c.hysteria2Relay.remote.(*pinnedConn); !ok || remote.addr.String() != "192.0.2.1:8443" {
+		t.Errorf("relay sends to %v, want the first pinned address", c.hysteria2Relay.remote)
+	}
+}
@@ -0,0 +1,189 @@
+package IEnvoyProxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// portSearchRange - How many ports above the preferred one are tried, before giving up.
+const portSearchRange = 100
+
+// portStartAttempts - How often a transport, which binds its port itself, is restarted on another port, when
+// some other app grabbed the reserved one in the short moment between releasing and the transport binding it.
+const portStartAttempts = 3
+
+// listenAddress - Where a transport listens: A host and a range of ports to try, or a Unix domain socket.
+type listenAddress struct {
+	host  string
+	first int
+	last  int
+
+	socket string
+}
+
+// parseListenAddress - Parse an address like "127.0.0.1:1080" or "127.0.0.1:1080-1089".
+//
+// An empty host means loopback, not all interfaces.
+func parseListenAddress(address string) (listenAddress, error) {
+	host, ports, err := net.SplitHostPort(strings.TrimSpace(address))
+	if err != nil {
+		return listenAddress{}, fmt.Errorf("invalid listen address %q: %w", address, err)
+	}
+
+	if host == "" {
+		host = "127.0.0.1"
+	} else if net.ParseIP(host) == nil {
+		return listenAddress{}, fmt.Errorf("invalid listen address %q: host needs to be an IP address", address)
+	}
+
+	first, last, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		last = first
+	}
+
+	la := listenAddress{host: host}
+
+	la.first, err = strconv.Atoi(first)
+	if err == nil {
+		la.last, err = strconv.Atoi(last)
+	}
+
+	if err != nil || la.first < 1 || la.last > 65535 || la.first > la.last {
+		return listenAddress{}, fmt.Errorf("invalid listen address %q: invalid port (range)", address)
+	}
+
+	return la, nil
+}
+
+// defaultListenAddress - Loopback and a range of ports, starting at the given one.
+func defaultListenAddress(preferred int) listenAddress {
+	return listenAddress{host: "127.0.0.1", first: preferred, last: min(preferred+portSearchRange, 65535)}
+}
+
+// inUse - The error to return, when all ports are taken.
+func (la listenAddress) inUse() error {
+	if la.first == la.last {
+		return fmt.Errorf("port %d on %s: %w", la.first, la.host, syscall.EADDRINUSE)
+	}
+
+	return fmt.Errorf("all ports from %d to %d on %s: %w", la.first, la.last, la.host, syscall.EADDRINUSE)
+}
+
+// portReservation - A port bound for TCP and UDP, so no other app can take it.
+type portReservation struct {
+	tcp net.Listener
+	udp net.PacketConn
+}
+
+// reservePort - Find a free port by actually binding it.
+//
+// @param la The host to bind and the range of ports to try in order.
+//
+// @returns a reservation, which needs to be released or handed over to the transport.
+//
+// @throws if no port in the range is free for both TCP and UDP, or if binding fails for another reason than the
+// port being taken, e.g. a host which isn't a local address.
+func reservePort(la listenAddress) (*portReservation, error) {
+	for port := la.first; port <= la.last; port++ {
+		address := net.JoinHostPort(la.host, strconv.Itoa(port))
+
+		tcp, err := net.Listen("tcp", address)
+		if err != nil {
+			if isAddrInUse(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		udp, err := net.ListenPacket("udp", address)
+		if err != nil {
+			_ = tcp.Close()
+
+			if isAddrInUse(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		return &portReservation{tcp, udp}, nil
+	}
+
+	return nil, la.inUse()
+}
+
+// port - The reserved port.
+func (r *portReservation) port() int {
+	return r.tcp.Addr().(*net.TCPAddr).Port
+}
+
+// release - Free the port again, so the transport can bind it itself.
+func (r *portReservation) release() {
+	_ = r.tcp.Close()
+	_ = r.udp.Close()
+}
+
+// listener - Hand the bound TCP listener over to a transport which can use one.
+func (r *portReservation) listener() net.Listener {
+	_ = r.udp.Close()
+
+	return r.tcp
+}
+
+// startOnFreePort - Start a transport which binds its port itself on a reserved port.
+//
+// If some other app grabbed the port in the short moment between releasing it and the transport binding it,
+// the next free port is tried.
+//
+// @param la The host to listen on and the range of ports to try in order.
+//
+// @param start Starts the transport on the given port.
+//
+// @returns the port the transport is listening on.
+//
+// @throws if no port is free or if the transport fails to start for any other reason.
+func startOnFreePort(la listenAddress, start func(port int) error) (int, error) {
+	requested := la
+	var err error
+
+	for attempt := 0; attempt < portStartAttempts && la.first <= la.last; attempt++ {
+		var reservation *portReservation
+
+		reservation, err = reservePort(la)
+		if err != nil {
+			return 0, err
+		}
+
+		port := reservation.port()
+		reservation.release()
+
+		err = start(port)
+		if err == nil {
+			return port, nil
+		}
+
+		if !isAddrInUse(err) {
+			return 0, err
+		}
+
+		la.first = port + 1
+	}
+
+	if la.first > la.last {
+		return 0, requested.inUse()
+	}
+
+	return 0, err
+}
+
+// isAddrInUse - Checks, if an error was caused by a port being taken.
+//
+// V2Ray's errors don't support unwrapping, hence the fallback to the message.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || strings.Contains(err.Error(), syscall.EADDRINUSE.Error())
+}
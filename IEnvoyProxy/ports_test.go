@@ -0,0 +1,67 @@
+package IEnvoyProxy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReservePort(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer taken.Close()
+
+	port := taken.Addr().(*net.TCPAddr).Port
+
+	reservation, err := reservePort(listenAddress{host: "127.0.0.1", first: port, last: min(port+10, 65535)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reservation.port() == port {
+		t.Errorf("port() = %d, which is taken", port)
+	}
+
+	reservation.release()
+
+	_, err = reservePort(listenAddress{host: "127.0.0.1", first: port, last: port})
+	if err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("reservePort() of a taken port error = %v, want in use", err)
+	}
+
+	// Not a local address: Trying other ports is pointless.
+	_, err = reservePort(listenAddress{host: "192.0.2.1", first: 1080, last: 1180})
+	if err == nil || isAddrInUse(err) || strings.Contains(err.Error(), "already in use") {
+		t.Errorf("reservePort() on a foreign address error = %v, want the bind error", err)
+	}
+}
+
+func TestHysteria2KeepsPort(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	c.Hysteria2Server = "hysteria2://auth@192.0.2.1:443"
+
+	if err := c.Start(Hysteria2, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(c.Port(Hysteria2)))
+
+	// Handed over to Hysteria2 instead of released for it to bind.
+	if ln, err := net.Listen("tcp", address); err == nil {
+		_ = ln.Close()
+		t.Errorf("%s free while Hysteria2 runs", address)
+	}
+
+	c.Stop(Hysteria2)
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("%s still taken after Stop: %v", address, err)
+	}
+
+	_ = ln.Close()
+}
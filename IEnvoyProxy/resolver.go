@@ -0,0 +1,586 @@
+package IEnvoyProxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	v2ray "github.com/v2fly/v2ray-core/v5/envoy"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolver - Table of pinned domains and DNS resolvers, consulted by all transports.
+//
+// Transports we control the dialer of (Lyrebird, V2Ray) resolve hostnames with `goResolver`, which asks an
+// in-process DNS server answering from this table, or with the configured DoH/DoT resolvers. Hysteria2's server is
+// resolved before it's started, or, if pinned to several IP addresses, reached through a `pinnedConn`. Snowflake
+// resolves its broker, front and ICE server domains with Go's default resolver, which is left alone, as it's shared
+// with the app, so `checkBypass` refuses to start it, when that would bypass this table or the DoH/DoT resolvers.
+//
+// As V2Ray's table is process-wide, so is this, and shared by all `Controller`s.
+type resolver struct {
+	mutex sync.RWMutex
+	pins  map[string][]string
+
+	upstreams      []*dnsUpstream
+	systemFallback bool
+	cache          map[dnsCacheKey]dnsCacheEntry
+
+	// goResolver - Go's resolver, asking us.
+	goResolver *net.Resolver
+
+	// hookOnce - Hand `goResolver` to V2Ray, once the first domain is pinned or the first resolver added.
+	hookOnce sync.Once
+}
+
+type dnsCacheKey struct {
+	domain string
+	qtype  dnsmessage.Type
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+var sharedResolver *resolver
+
+func init() {
+	// Not in the declaration, as our DoH/DoT upstreams look up pins in it, which would be an initialization cycle.
+	sharedResolver = newResolver()
+}
+
+// Used for everything neither pinned nor resolved by DoH/DoT.
+var systemResolver = &net.Resolver{}
+
+func newResolver() *resolver {
+	r := &resolver{
+		pins:  make(map[string][]string),
+		cache: make(map[dnsCacheKey]dnsCacheEntry),
+	}
+
+	r.goResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+
+			go r.serve(server)
+
+			return client, nil
+		},
+	}
+
+	return r
+}
+
+const pinnedTTL = 60
+
+// normalizeDomain - The key of a domain in the table: Lowercase, without trailing dot, like V2Ray's.
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// pin - Resolve the given domain to the given IP addresses.
+func (r *resolver) pin(domain string, ips []string) {
+	r.mutex.Lock()
+	r.pins[normalizeDomain(domain)] = append([]string(nil), ips...)
+	r.mutex.Unlock()
+
+	r.hookOnce.Do(r.hook)
+}
+
+// unpin - Resolve the given domain normally again.
+func (r *resolver) unpin(domain string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.pins, normalizeDomain(domain))
+}
+
+// pinned - The IP addresses the given domain is pinned to, in the order they should be tried.
+func (r *resolver) pinned(domain string) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return append([]string(nil), r.pins[normalizeDomain(domain)]...)
+}
+
+// rotate - Move an IP address which failed to the end of the list of the given domain.
+func (r *resolver) rotate(domain, ip string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	domain = normalizeDomain(domain)
+	ips := r.pins[domain]
+
+	for i, existing := range ips {
+		if existing == ip {
+			r.pins[domain] = append(append(ips[:i:i], ips[i+1:]...), ip)
+			break
+		}
+	}
+}
+
+// addUpstream - Add a DoH/DoT resolver, to be tried after all previously added ones.
+func (r *resolver) addUpstream(upstream *dnsUpstream) {
+	r.mutex.Lock()
+	r.upstreams = append(r.upstreams, upstream)
+	r.cache = make(map[dnsCacheKey]dnsCacheEntry)
+	r.mutex.Unlock()
+
+	r.hookOnce.Do(r.hook)
+}
+
+// clearUpstreams - Remove all DoH/DoT resolvers.
+func (r *resolver) clearUpstreams() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.upstreams = nil
+	r.cache = make(map[dnsCacheKey]dnsCacheEntry)
+}
+
+// setSystemFallback - Use the system resolver, when no DoH/DoT resolver answers.
+func (r *resolver) setSystemFallback(enabled bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.systemFallback = enabled
+}
+
+// dialer - Wrap a dial function, so pinned domains are dialed by IP address.
+//
+// The IP addresses are tried in turn, until one succeeds. Since only the address to dial is changed,
+// transports keep using the domain for TLS and HTTP. This also works with upstream proxies, which would
+// otherwise resolve the domain themselves.
+func (r *resolver) dialer(dialFn base.DialFunc) base.DialFunc {
+	return func(network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return dialFn(network, address)
+		}
+
+		ips := r.pinned(host)
+		if len(ips) < 1 {
+			return dialFn(network, address)
+		}
+
+		var lastErr error
+
+		for _, ip := range ips {
+			conn, err := dialFn(network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+
+			r.rotate(host, ip)
+			lastErr = err
+		}
+
+		return nil, lastErr
+	}
+}
+
+// checkBypass - Check, that a transport resolving the given domains with the system resolver, like Snowflake,
+// doesn't bypass pins or DoH/DoT resolvers.
+//
+// @throws if one of the domains is pinned, or if DoH/DoT resolvers are configured without system fallback.
+func (r *resolver) checkBypass(domains []string) error {
+	for _, domain := range domains {
+		if len(r.pinned(domain)) > 0 {
+			return fmt.Errorf("%s is pinned, but would be resolved with the system resolver", domain)
+		}
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(domains) > 0 && len(r.upstreams) > 0 && !r.systemFallback {
+		return errors.New("DNS resolvers are configured without system fallback, but the system resolver would be used")
+	}
+
+	return nil
+}
+
+// pinnedFailover - How long the current IP address of a `pinnedConn` may leave datagrams unanswered, before the
+// next one is tried. QUIC retransmits and sends keep-alives well within that. A variable for tests.
+var pinnedFailover = 5 * time.Second
+
+// pinnedConn - Sends UDP datagrams to the IP addresses a domain is pinned to, for transports which resolve their
+// server only once, like Hysteria2.
+//
+// Datagrams go to the first address, until it doesn't answer for `pinnedFailover`. Then that address is moved to
+// the end of the pins, like `dialer` does, and the next one is used. The transport notices the switch as a broken
+// connection and reconnects, now to the new address.
+type pinnedConn struct {
+	*net.UDPConn
+
+	resolver *resolver
+	domain   string
+	port     string
+
+	mutex   sync.Mutex
+	current string
+	addr    *net.UDPAddr
+
+	// unanswered - When the first datagram was sent to the current address since its last answer.
+	unanswered time.Time
+}
+
+// newPinnedConn - Open a UDP socket to send to the IP addresses the given domain is pinned to.
+//
+// @throws if the domain isn't pinned or the socket cannot be opened.
+func (r *resolver) newPinnedConn(domain, port string) (*pinnedConn, error) {
+	ips := r.pinned(domain)
+	if len(ips) < 1 {
+		return nil, fmt.Errorf("%s is not pinned", domain)
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &pinnedConn{UDPConn: conn, resolver: r, domain: domain, port: port}
+
+	if err = c.use(ips[0]); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// use - Send to the given IP address from now on. Needs the mutex, if already in use.
+func (c *pinnedConn) use(ip string) error {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, c.port))
+	if err != nil {
+		return err
+	}
+
+	c.current = ip
+	c.addr = addr
+	c.unanswered = time.Time{}
+
+	return nil
+}
+
+func (c *pinnedConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+
+	now := time.Now()
+
+	if c.unanswered.IsZero() {
+		c.unanswered = now
+	} else if now.Sub(c.unanswered) > pinnedFailover {
+		c.resolver.rotate(c.domain, c.current)
+
+		if ips := c.resolver.pinned(c.domain); len(ips) > 0 && ips[0] != c.current {
+			ptlog.Warnf("%s didn't answer, trying %s", ptlog.ElideAddr(c.current), ptlog.ElideAddr(ips[0]))
+
+			if err := c.use(ips[0]); err != nil {
+				ptlog.Warnf("Failed to switch to %s: %s", ptlog.ElideAddr(ips[0]), ptlog.ElideError(err))
+			}
+		}
+
+		c.unanswered = now
+	}
+
+	addr := c.addr
+
+	c.mutex.Unlock()
+
+	return c.UDPConn.WriteTo(b, addr)
+}
+
+// Read - Read the next datagram from the current IP address. Late answers of previous ones are dropped.
+func (c *pinnedConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.UDPConn.ReadFromUDP(b)
+		if err != nil {
+			return n, err
+		}
+
+		c.mutex.Lock()
+
+		current := addr.IP.Equal(c.addr.IP) && addr.Port == c.addr.Port
+		if current {
+			c.unanswered = time.Time{}
+		}
+
+		c.mutex.Unlock()
+
+		if current {
+			return n, nil
+		}
+	}
+}
+
+// hook - Let V2Ray resolve with us, so its QUIC transports honor pinned domains and DoH/DoT resolvers.
+func (r *resolver) hook() {
+	v2ray.SetResolver(r.goResolver)
+}
+
+// netResolver - The resolver for dialers we control: `goResolver`, if there is anything to do for it,
+// otherwise the system resolver.
+func (r *resolver) netResolver() *net.Resolver {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(r.pins) < 1 && len(r.upstreams) < 1 {
+		return systemResolver
+	}
+
+	return r.goResolver
+}
+
+// resolveServer - Replace the host of a server URL like Hysteria2's with its IP address, for transports which
+// resolve with Go's default resolver. The host is kept as "sni" query parameter, unless there already is one.
+//
+// Port hopping ("host:1000-2000") is supported, as the URL is not parsed as a whole.
+//
+// @returns the URL unchanged, if it contains an IP address already or if nothing is pinned and no DoH/DoT
+// resolver configured.
+//
+// @throws if the host cannot be resolved.
+func (r *resolver) resolveServer(ctx context.Context, server string) (string, error) {
+	scheme, rest, ok := strings.Cut(server, "://")
+	if !ok || r.netResolver() == systemResolver {
+		return server, nil
+	}
+
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+
+	authority, tail := rest[:end], rest[end:]
+	at := strings.LastIndex(authority, "@") + 1
+
+	host, ports, _ := strings.Cut(authority[at:], ":")
+	if host == "" || strings.HasPrefix(host, "[") || net.ParseIP(host) != nil {
+		return server, nil
+	}
+
+	ips, err := r.lookup(ctx, host, dnsmessage.TypeA)
+	if err == nil && len(ips) < 1 {
+		ips, err = r.lookup(ctx, host, dnsmessage.TypeAAAA)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(ips) < 1 {
+		return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	ip := ips[0].String()
+	if ips[0].To4() == nil {
+		ip = "[" + ip + "]"
+	}
+
+	if ports != "" {
+		ip += ":" + ports
+	}
+
+	tail, fragment, hasFragment := strings.Cut(tail, "#")
+	path, rawQuery, _ := strings.Cut(tail, "?")
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", err
+	}
+
+	if query.Get("sni") == "" {
+		query.Set("sni", host)
+	}
+
+	server = scheme + "://" + authority[:at] + ip + path + "?" + query.Encode()
+
+	if hasFragment {
+		server += "#" + fragment
+	}
+
+	return server, nil
+}
+
+// lookup - Resolve a domain: Pinned domains from our table, everything else with the DoH/DoT resolvers in order,
+// and the system resolver, if there are none or as a fallback, if enabled.
+func (r *resolver) lookup(ctx context.Context, domain string, qtype dnsmessage.Type) ([]net.IP, error) {
+	if ips := r.pinned(domain); len(ips) > 0 {
+		result := make([]net.IP, 0, len(ips))
+
+		for _, ip := range ips {
+			result = append(result, net.ParseIP(ip))
+		}
+
+		return result, nil
+	}
+
+	key := dnsCacheKey{normalizeDomain(domain), qtype}
+
+	r.mutex.RLock()
+	upstreams := r.upstreams
+	systemFallback := r.systemFallback
+	entry, cached := r.cache[key]
+	r.mutex.RUnlock()
+
+	if cached && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	var err error
+
+	for _, upstream := range upstreams {
+		var ips []net.IP
+		var ttl time.Duration
+
+		ips, ttl, err = upstream.resolve(ctx, key.domain, qtype)
+		if err == nil {
+			r.mutex.Lock()
+			r.cache[key] = dnsCacheEntry{ips, time.Now().Add(ttl)}
+			r.mutex.Unlock()
+
+			return ips, nil
+		}
+
+		var dnsErr *net.DNSError
+
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, err
+		}
+
+		ptlog.Warnf("DNS resolver %s failed: %s", ptlog.ElideAddr(upstream.host), ptlog.ElideError(err))
+	}
+
+	if len(upstreams) > 0 && !systemFallback {
+		return nil, err
+	}
+
+	addrs, err := systemResolver.LookupIPAddr(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]net.IP, 0, len(addrs))
+
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == (qtype == dnsmessage.TypeA) {
+			result = append(result, addr.IP)
+		}
+	}
+
+	return result, nil
+}
+
+// serve - Answer DNS queries on a stream connection, as sent by Go's resolver, until it's closed.
+func (r *resolver) serve(conn net.Conn) {
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	for {
+		var length [2]byte
+
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		response, err := r.answer(query)
+		if err != nil {
+			return
+		}
+
+		binary.BigEndian.PutUint16(length[:], uint16(len(response)))
+
+		if _, err = conn.Write(append(length[:], response...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer - Build the response to a DNS query. Only A and AAAA queries are supported.
+func (r *resolver) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	header.Response = true
+	header.RecursionAvailable = true
+
+	var ips []net.IP
+
+	if question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeAAAA {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+		defer cancel()
+
+		ips, err = r.lookup(ctx, strings.TrimSuffix(question.Name.String(), "."), question.Type)
+
+		var dnsErr *net.DNSError
+
+		switch {
+		case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+			header.RCode = dnsmessage.RCodeNameError
+
+		case err != nil:
+			header.RCode = dnsmessage.RCodeServerFailure
+		}
+	} else {
+		header.RCode = dnsmessage.RCodeNotImplemented
+	}
+
+	b := dnsmessage.NewBuilder(nil, header)
+	b.EnableCompression()
+
+	if err = b.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	if err = b.Question(question); err != nil {
+		return nil, err
+	}
+
+	if err = b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: pinnedTTL}
+
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if question.Type == dnsmessage.TypeA {
+				err = b.AResource(rh, dnsmessage.AResource{A: [4]byte(ip4)})
+			}
+		} else if ip16 := ip.To16(); ip16 != nil && question.Type == dnsmessage.TypeAAAA {
+			err = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte(ip16)})
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
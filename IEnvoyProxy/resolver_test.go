@@ -0,0 +1,177 @@
+package IEnvoyProxy
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGoResolverAnswersPins(t *testing.T) {
+	r := newTestResolver(map[string][]string{"pinned.example": {"192.0.2.1", "2001:db8::1"}})
+
+	ips, err := r.goResolver.LookupHost(context.Background(), "Pinned.Example.")
+	if err != nil {
+		t.Fatalf("LookupHost() error = %v", err)
+	}
+
+	slices.Sort(ips)
+
+	if !slices.Equal(ips, []string{"192.0.2.1", "2001:db8::1"}) {
+		t.Errorf("LookupHost() = %v", ips)
+	}
+}
+
+func TestPinningLeavesDefaultResolverAlone(t *testing.T) {
+	sharedResolver.pin("untouched.example", []string{"192.0.2.1"})
+	defer sharedResolver.unpin("untouched.example")
+
+	if net.DefaultResolver.Dial != nil || net.DefaultResolver.PreferGo {
+		t.Error("net.DefaultResolver was changed")
+	}
+
+	if sharedResolver.netResolver() != sharedResolver.goResolver {
+		t.Error("dialers don't resolve with the pins")
+	}
+}
+
+func TestResolveServer(t *testing.T) {
+	r := newTestResolver(map[string][]string{
+		"hy.example": {"192.0.2.1", "192.0.2.2"},
+		"v6.example": {"2001:db8::1"},
+	})
+
+	tests := []struct {
+		name   string
+		server string
+		want   string
+	}{
+		{"host", "hysteria2://auth@hy.example:443/?insecure=1",
+			"hysteria2://auth@192.0.2.1:443/?insecure=1&sni=hy.example"},
+		{"port hopping", "hy2://auth@hy.example:1000-2000,3000?sni=other.example",
+			"hy2://auth@192.0.2.1:1000-2000,3000?sni=other.example"},
+		{"IPv6", "hysteria2://auth@v6.example", "hysteria2://auth@[2001:db8::1]?sni=v6.example"},
+		{"fragment", "hysteria2://hy.example#name", "hysteria2://192.0.2.1?sni=hy.example#name"},
+		{"IP address", "hysteria2://auth@192.0.2.9:443", "hysteria2://auth@192.0.2.9:443"},
+		{"IPv6 address", "hysteria2://auth@[2001:db8::9]:443", "hysteria2://auth@[2001:db8::9]:443"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.resolveServer(context.Background(), tt.server)
+			if err != nil {
+				t.Fatalf("resolveServer() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("resolveServer() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Nothing to do without pins and DoH/DoT resolvers, so not even looked up.
+	unconfigured := newTestResolver(map[string][]string{})
+
+	got, err := unconfigured.resolveServer(context.Background(), "hysteria2://auth@hy.example:443")
+	if err != nil || got != "hysteria2://auth@hy.example:443" {
+		t.Errorf("resolveServer() = %q, %v, want it unchanged", got, err)
+	}
+}
+
+// udpServer - Listens on the given address and answers with the received datagrams, if echo is true.
+func udpServer(t *testing.T, address string, echo bool) *net.UDPConn {
+	t.Helper()
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Skipf("can't listen on %s: %s", address, err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 1500)
+
+		for {
+			n, peer, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			if echo {
+				_, _ = conn.WriteToUDP(buf[:n], peer)
+			}
+		}
+	}()
+
+	return conn
+}
+
+func TestPinnedConnFailover(t *testing.T) {
+	defer func(failover time.Duration) {
+		pinnedFailover = failover
+	}(pinnedFailover)
+
+	pinnedFailover = 100 * time.Millisecond
+
+	// Both on the same port, as the port comes from the server URL.
+	silent := udpServer(t, "127.0.0.1:0", false)
+	port := strconv.Itoa(silent.LocalAddr().(*net.UDPAddr).Port)
+	udpServer(t, net.JoinHostPort("127.0.0.2", port), true)
+
+	r := newTestResolver(map[string][]string{"hy.example": {"127.0.0.1", "127.0.0.2"}})
+
+	conn, err := r.newPinnedConn("hy.example", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	answers := make(chan string, 10)
+
+	go func() {
+		buf := make([]byte, 1500)
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+
+			answers <- string(buf[:n])
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		if _, err = conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case answer := <-answers:
+			if answer != "ping" {
+				t.Errorf("answer = %q", answer)
+			}
+
+			if ips := r.pinned("hy.example"); !slices.Equal(ips, []string{"127.0.0.2", "127.0.0.1"}) {
+				t.Errorf("pinned() = %v, want the silent address last", ips)
+			}
+
+			return
+
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	t.Fatal("didn't switch to the answering address")
+}
@@ -0,0 +1,61 @@
+package IEnvoyProxy
+
+import (
+	"regexp"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/safelog"
+)
+
+const scrubbed = "[scrubbed]"
+
+// scrubPatterns - What to remove from log messages besides IP addresses, which Lyrebird's scrubber handles.
+// The first and the second group, if any, are kept before and after the scrubbed part.
+//
+// V2Ray and Hysteria2 log hostnames, UUIDs, passwords and server URLs with credentials verbatim. Hysteria2 logs
+// fields as JSON, like `{"addr": "example.com:443"}`.
+var scrubPatterns = []*regexp.Regexp{
+	// Credentials in URLs, like in `Hysteria2Server`: "hysteria2://auth@example.com".
+	regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^\s/?#@"']+(@)`),
+
+	// Passwords and other secrets as key-value pairs, in JSON, YAML, URL queries and bridge lines.
+	regexp.MustCompile(`(?i)(\b(?:password|passwd|pass|auth|secret|token|creds|credentials|cert)["']?\s*[:=]\s*["']?)` +
+		`[^\s"',;&}]+`),
+
+	// UUIDs, like `V2RayId`.
+	regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`),
+
+	// Hostnames, in any case, like "EXAMPLE.COM" in HTTP headers. See `goIdentifier` for what is kept.
+	regexp.MustCompile(`\b(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,63}\b`),
+}
+
+// goIdentifier - Qualified Go identifiers, like "context.Canceled" or "io.EOF", which V2Ray mentions in its errors
+// and which look like hostnames: Lower case package path, upper case in the last part.
+var goIdentifier = regexp.MustCompile(`^[a-z0-9.]+\.[A-Za-z]*[A-Z][A-Za-z]*$`)
+
+// scrub - Remove IP addresses, hostnames, UUIDs, passwords and bridge certs from a log message.
+func scrub(message string) string {
+	for _, pattern := range scrubPatterns {
+		message = pattern.ReplaceAllStringFunc(message, func(match string) string {
+			loc := pattern.FindStringSubmatchIndex(match)
+
+			if len(loc) > 2 {
+				suffix := ""
+				if len(loc) > 4 {
+					suffix = match[loc[4]:]
+				}
+
+				return match[:loc[3]] + scrubbed + suffix
+			}
+
+			// Keep Go source files and identifiers, which V2Ray mentions in its errors.
+			if strings.HasSuffix(match, ".go") || goIdentifier.MatchString(match) {
+				return match
+			}
+
+			return scrubbed
+		})
+	}
+
+	return string(safelog.Scrub([]byte(message)))
+}
@@ -0,0 +1,534 @@
+// Package shareuri parses the share links proxy operators hand out to users
+// (`vmess://`, `vless://`, `trojan://`, `ss://` and `hysteria2://`) into their
+// components, so the Controller can be configured from a single string.
+package shareuri
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ProtocolVmess - VMess, carried by V2Ray.
+	ProtocolVmess = "vmess"
+
+	// ProtocolVless - VLESS, carried by V2Ray.
+	ProtocolVless = "vless"
+
+	// ProtocolTrojan - Trojan, carried by V2Ray.
+	ProtocolTrojan = "trojan"
+
+	// ProtocolShadowsocks - Shadowsocks, carried by V2Ray.
+	ProtocolShadowsocks = "shadowsocks"
+
+	// ProtocolHysteria2 - Hysteria 2.
+	ProtocolHysteria2 = "hysteria2"
+)
+
+const (
+	// NetworkWs - WebSocket over TLS.
+	NetworkWs = "ws"
+
+	// NetworkQuic - QUIC with a packet header obfuscation.
+	NetworkQuic = "quic"
+
+	// NetworkTcp - Plain TCP.
+	NetworkTcp = "tcp"
+)
+
+// ErrUnsupported - The link is well-formed, but describes a configuration none of our transports can handle.
+var ErrUnsupported = errors.New("unsupported configuration")
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// The QUIC header obfuscations V2Ray supports and we have a transport for.
+var quicHeaders = map[string]bool{
+	"srtp":         true,
+	"wechat-video": true,
+}
+
+// The Shadowsocks ciphers V2Ray supports, and the names they go by in the wild.
+var ssCiphers = map[string]string{
+	"aes-128-gcm":            "aes-128-gcm",
+	"aes-256-gcm":            "aes-256-gcm",
+	"chacha20-poly1305":      "chacha20-poly1305",
+	"chacha20-ietf-poly1305": "chacha20-poly1305",
+}
+
+// The fingerprint names used in links, mapped to V2Ray's uTLS presets.
+var fingerprints = map[string]string{
+	"chrome":     "chrome_auto",
+	"firefox":    "firefox_auto",
+	"safari":     "safari_auto",
+	"ios":        "ios_auto",
+	"android":    "android_11_okhttp",
+	"edge":       "edge_auto",
+	"360":        "360_auto",
+	"qq":         "qq_auto",
+	"random":     "randomized",
+	"randomized": "randomized",
+}
+
+// Link - A parsed share link.
+type Link struct {
+	// Protocol - One of the `Protocol*` constants.
+	Protocol string
+
+	// Network - One of the `Network*` constants. Empty for Hysteria 2.
+	Network string
+
+	// QuicHeader - Packet header obfuscation, "srtp" or "wechat-video". (NetworkQuic only!)
+	QuicHeader string
+
+	// Address - Hostname or IP address of the server.
+	Address string
+
+	// Port - Port of the server.
+	Port string
+
+	// Id - UUID (VMess, VLESS) or password (Trojan, Shadowsocks, Hysteria 2) to authenticate with.
+	Id string
+
+	// Method - Shadowsocks cipher. (ProtocolShadowsocks only!)
+	Method string
+
+	// Path - Path of the WebSocket. (NetworkWs only!)
+	Path string
+
+	// Host - HTTP Host header, if different from `Address`.
+	Host string
+
+	// Sni - TLS server name, if different from `Address`.
+	Sni string
+
+	// Fingerprint - uTLS ClientHello to imitate, as a V2Ray preset name, e.g. "chrome_auto". (NetworkWs only!)
+	Fingerprint string
+
+	// AllowInsecure - Don't verify the server's certificate.
+	AllowInsecure bool
+
+	// Name - Human-readable name of the endpoint, if any.
+	Name string
+
+	// Uri - The link, normalized. (ProtocolHysteria2 only, which takes the link as its configuration.)
+	Uri string
+}
+
+// Parse - Parse and validate a share link.
+//
+// @param uri A `vmess://`, `vless://`, `trojan://`, `ss://`, `hysteria2://` or `hy2://` link.
+//
+// @returns the parsed link or an error, if the link is malformed. Links which are well-formed, but
+// use options our transports can't handle, return an error wrapping `ErrUnsupported`.
+func Parse(uri string) (*Link, error) {
+	uri = strings.TrimSpace(uri)
+
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		return nil, fmt.Errorf("not a share link: %q", uri)
+	}
+
+	switch strings.ToLower(scheme) {
+	case "vmess":
+		return parseVmess(rest)
+
+	case "vless":
+		return parseV2RayUrl(ProtocolVless, uri)
+
+	case "trojan":
+		return parseV2RayUrl(ProtocolTrojan, uri)
+
+	case "ss":
+		return parseShadowsocks(rest)
+
+	case "hysteria2", "hy2":
+		return parseHysteria2(rest)
+
+	default:
+		return nil, fmt.Errorf("%w: scheme %q", ErrUnsupported, scheme)
+	}
+}
+
+// parseVmess - Parse the base64-encoded JSON format popularized by v2rayN.
+func parseVmess(payload string) (*Link, error) {
+	payload, name, _ := strings.Cut(payload, "#")
+
+	data, err := decodeBase64(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vmess link: %w", err)
+	}
+
+	// Numbers are sometimes encoded as strings, sometimes not.
+	var raw map[string]any
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid vmess link: %w", err)
+	}
+
+	field := func(key string) string {
+		switch v := raw[key].(type) {
+		case string:
+			return strings.TrimSpace(v)
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return ""
+		}
+	}
+
+	l := &Link{
+		Protocol: ProtocolVmess,
+		Network:  field("net"),
+		Address:  field("add"),
+		Port:     field("port"),
+		Id:       field("id"),
+		Host:     field("host"),
+		Sni:      field("sni"),
+		Name:     field("ps"),
+
+		Fingerprint:   fingerprint(field("fp")),
+		AllowInsecure: isTrue(field("allowInsecure")),
+	}
+
+	if l.Name == "" {
+		l.Name, _ = url.PathUnescape(name)
+	}
+
+	if l.Network == "" {
+		l.Network = NetworkTcp
+	}
+
+	security := field("tls")
+
+	switch l.Network {
+	case NetworkWs:
+		l.Path = field("path")
+
+	case NetworkQuic:
+		// v2rayN abuses "host" for the QUIC encryption and "path" for its key.
+		if err = checkQuicEncryption(l.Host, field("path")); err != nil {
+			return nil, err
+		}
+		l.Host = ""
+		l.QuicHeader = field("type")
+	}
+
+	if err = l.validate(security); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// parseV2RayUrl - Parse the URL format used by VLESS and Trojan links.
+func parseV2RayUrl(protocol, uri string) (*Link, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s link: %w", protocol, err)
+	}
+
+	if u.User == nil {
+		return nil, fmt.Errorf("invalid %s link: missing credentials", protocol)
+	}
+
+	q := u.Query()
+
+	l := &Link{
+		Protocol: protocol,
+		Network:  q.Get("type"),
+		Address:  u.Hostname(),
+		Port:     u.Port(),
+		Id:       u.User.Username(),
+		Path:     q.Get("path"),
+		Host:     q.Get("host"),
+		Sni:      q.Get("sni"),
+		Name:     u.Fragment,
+
+		Fingerprint:   fingerprint(q.Get("fp")),
+		AllowInsecure: isTrue(q.Get("allowInsecure")),
+	}
+
+	if l.Network == "" {
+		l.Network = NetworkTcp
+	}
+
+	security := q.Get("security")
+	if security == "" && protocol == ProtocolTrojan {
+		security = "tls"
+	}
+
+	if l.Network == NetworkQuic {
+		if err = checkQuicEncryption(q.Get("quicSecurity"), q.Get("key")); err != nil {
+			return nil, err
+		}
+		l.QuicHeader = q.Get("headerType")
+	}
+
+	if encryption := q.Get("encryption"); protocol == ProtocolVless && encryption != "" && encryption != "none" {
+		return nil, fmt.Errorf("%w: vless encryption %q", ErrUnsupported, encryption)
+	}
+
+	if flow := q.Get("flow"); flow != "" {
+		return nil, fmt.Errorf("%w: %s flow %q", ErrUnsupported, protocol, flow)
+	}
+
+	if err = l.validate(security); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// parseShadowsocks - Parse SIP002 links as well as the legacy, completely base64-encoded format.
+func parseShadowsocks(rest string) (*Link, error) {
+	l := &Link{
+		Protocol: ProtocolShadowsocks,
+		Network:  NetworkTcp,
+	}
+
+	body, name, _ := strings.Cut(rest, "#")
+	l.Name, _ = url.PathUnescape(name)
+
+	var userInfo string
+
+	if !strings.Contains(body, "@") {
+		// Legacy: ss://base64(method:password@host:port)
+		data, err := decodeBase64(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ss link: %w", err)
+		}
+
+		var hostPort string
+		var ok bool
+
+		userInfo, hostPort, ok = cutLast(string(data), "@")
+		if !ok {
+			return nil, errors.New("invalid ss link: missing server")
+		}
+
+		l.Address, l.Port, err = net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ss link: %w", err)
+		}
+	} else {
+		// SIP002: ss://base64url(method:password)@host:port, or percent-encoded for AEAD-2022 ciphers.
+		u, err := url.Parse("ss://" + body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ss link: %w", err)
+		}
+
+		l.Address = u.Hostname()
+		l.Port = u.Port()
+
+		if password, ok := u.User.Password(); ok {
+			userInfo = u.User.Username() + ":" + password
+		} else if data, err := decodeBase64(u.User.Username()); err == nil {
+			userInfo = string(data)
+		} else {
+			return nil, fmt.Errorf("invalid ss link: %w", err)
+		}
+
+		if plugin := u.Query().Get("plugin"); plugin != "" {
+			return nil, fmt.Errorf("%w: ss plugin %q", ErrUnsupported, plugin)
+		}
+	}
+
+	method, password, ok := strings.Cut(userInfo, ":")
+	if !ok || password == "" {
+		return nil, errors.New("invalid ss link: missing password")
+	}
+
+	l.Method, ok = ssCiphers[strings.ToLower(method)]
+	if !ok {
+		return nil, fmt.Errorf("%w: ss cipher %q", ErrUnsupported, method)
+	}
+
+	l.Id = password
+
+	if err := l.validate(""); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// parseHysteria2 - Validate a Hysteria 2 link. Hysteria 2 parses the link itself,
+// so we only normalize the scheme and strip the name.
+//
+// See https://v2.hysteria.network/docs/developers/URI-Scheme/
+func parseHysteria2(rest string) (*Link, error) {
+	rest, name, _ := strings.Cut(rest, "#")
+
+	// `url.Parse` can't be used on the authority, as Hysteria 2 allows port hopping
+	// with lists and ranges, e.g. "example.com:443,5000-6000".
+	authority, pathQuery := rest, ""
+	if i := strings.IndexAny(rest, "/?"); i >= 0 {
+		authority, pathQuery = rest[:i], rest[i:]
+	}
+
+	q, err := url.Parse(pathQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hysteria2 link: %w", err)
+	}
+
+	userInfo, hostPort, ok := cutLast(authority, "@")
+	if !ok {
+		userInfo, hostPort = "", authority
+	}
+
+	l := &Link{
+		Protocol: ProtocolHysteria2,
+		Id:       userInfo,
+		Sni:      q.Query().Get("sni"),
+		Uri:      "hysteria2://" + rest,
+
+		AllowInsecure: isTrue(q.Query().Get("insecure")),
+	}
+
+	l.Name, _ = url.PathUnescape(name)
+
+	l.Address, l.Port, err = net.SplitHostPort(hostPort)
+	if err != nil {
+		// No port given, Hysteria 2 defaults to 443.
+		l.Address = strings.Trim(hostPort, "[]")
+		l.Port = ""
+	}
+
+	if l.Address == "" {
+		return nil, errors.New("invalid hysteria2 link: missing server")
+	}
+
+	if l.Port != "" {
+		for _, part := range strings.Split(l.Port, ",") {
+			for _, p := range strings.SplitN(part, "-", 2) {
+				if err = checkPort(p); err != nil {
+					return nil, fmt.Errorf("invalid hysteria2 link: %w", err)
+				}
+			}
+		}
+	}
+
+	if obfs := q.Query().Get("obfs"); obfs != "" && obfs != "salamander" {
+		return nil, fmt.Errorf("%w: hysteria2 obfs %q", ErrUnsupported, obfs)
+	}
+
+	return l, nil
+}
+
+// validate - Check that a V2Ray link has everything we need and maps onto one of our transports.
+func (l *Link) validate(security string) error {
+	if l.Address == "" {
+		return fmt.Errorf("invalid %s link: missing server", l.Protocol)
+	}
+
+	if err := checkPort(l.Port); err != nil {
+		return fmt.Errorf("invalid %s link: %w", l.Protocol, err)
+	}
+
+	if l.Id == "" {
+		return fmt.Errorf("invalid %s link: missing credentials", l.Protocol)
+	}
+
+	if (l.Protocol == ProtocolVmess || l.Protocol == ProtocolVless) && !uuidPattern.MatchString(l.Id) {
+		return fmt.Errorf("invalid %s link: id is not a UUID", l.Protocol)
+	}
+
+	// None of our transports does REALITY or XTLS, whatever the network.
+	switch security {
+	case "", "none", "tls":
+	default:
+		return fmt.Errorf("%w: %s security %q", ErrUnsupported, l.Protocol, security)
+	}
+
+	switch l.Network {
+	case NetworkWs:
+		if security != "tls" {
+			return fmt.Errorf("%w: %s over WebSocket without TLS", ErrUnsupported, l.Protocol)
+		}
+
+		if l.Path == "" {
+			l.Path = "/"
+		}
+
+	case NetworkQuic:
+		if !quicHeaders[l.QuicHeader] {
+			return fmt.Errorf("%w: QUIC header %q", ErrUnsupported, l.QuicHeader)
+		}
+
+	case NetworkTcp:
+		if l.Protocol != ProtocolShadowsocks {
+			return fmt.Errorf("%w: %s over plain TCP", ErrUnsupported, l.Protocol)
+		}
+
+	default:
+		return fmt.Errorf("%w: %s network %q", ErrUnsupported, l.Protocol, l.Network)
+	}
+
+	return nil
+}
+
+// checkQuicEncryption - Our QUIC transports are hard-wired to V2Ray's "aes-128-gcm" with key "0".
+func checkQuicEncryption(encryption, key string) error {
+	if encryption != "" && encryption != "aes-128-gcm" {
+		return fmt.Errorf("%w: QUIC encryption %q", ErrUnsupported, encryption)
+	}
+
+	if key != "" && key != "0" {
+		return fmt.Errorf("%w: QUIC key", ErrUnsupported)
+	}
+
+	return nil
+}
+
+// fingerprint - Map the fingerprint names used in links to V2Ray's uTLS presets. Unknown names are
+// passed through, as they might already be V2Ray preset names.
+func fingerprint(name string) string {
+	name = strings.ToLower(name)
+
+	if preset, ok := fingerprints[name]; ok {
+		return preset
+	}
+
+	return name
+}
+
+func isTrue(value string) bool {
+	v, _ := strconv.ParseBool(value)
+
+	return v
+}
+
+func checkPort(port string) error {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+
+	return nil
+}
+
+// decodeBase64 - Links in the wild use any combination of standard/URL alphabet and padding.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// cutLast - Like `strings.Cut`, but around the last instance of sep, as passwords may contain it.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+
+	return s, "", false
+}
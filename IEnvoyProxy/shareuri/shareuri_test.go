@@ -0,0 +1,165 @@
+package shareuri
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+const testUuid = "a3482e88-686a-4a58-8126-99c9df64b7bf"
+
+func vmessLink(json string) string {
+	return "vmess://" + base64.StdEncoding.EncodeToString([]byte(json))
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+		want Link
+	}{
+		{
+			name: "vmess ws",
+			uri: vmessLink(`{"v":"2","ps":"name","add":"a.example","port":443,"id":"` + testUuid +
+				`","net":"ws","host":"h.example","path":"/p","tls":"tls","sni":"s.example","fp":"chrome"}`),
+			want: Link{Protocol: ProtocolVmess, Network: NetworkWs, Address: "a.example", Port: "443", Id: testUuid,
+				Path: "/p", Host: "h.example", Sni: "s.example", Fingerprint: "chrome_auto", Name: "name"},
+		},
+		{
+			name: "vmess quic url-safe base64",
+			uri: "vmess://" + base64.RawURLEncoding.EncodeToString([]byte(`{"add":"a.example","port":"443","id":"`+
+				testUuid+`","net":"quic","type":"srtp","host":"aes-128-gcm","path":"0"}`)),
+			want: Link{Protocol: ProtocolVmess, Network: NetworkQuic, QuicHeader: "srtp", Address: "a.example",
+				Port: "443", Id: testUuid},
+		},
+		{
+			name: "vless ws",
+			uri:  "vless://" + testUuid + "@x.example:443?type=ws&security=tls&path=%2Fws&allowInsecure=1#n",
+			want: Link{Protocol: ProtocolVless, Network: NetworkWs, Address: "x.example", Port: "443", Id: testUuid,
+				Path: "/ws", AllowInsecure: true, Name: "n"},
+		},
+		{
+			name: "vless quic",
+			uri:  "vless://" + testUuid + "@x.example:443?type=quic&headerType=wechat-video",
+			want: Link{Protocol: ProtocolVless, Network: NetworkQuic, QuicHeader: "wechat-video",
+				Address: "x.example", Port: "443", Id: testUuid},
+		},
+		{
+			name: "trojan ws defaults to tls and root path",
+			uri:  "trojan://pw@x.example:443?type=ws",
+			want: Link{Protocol: ProtocolTrojan, Network: NetworkWs, Address: "x.example", Port: "443", Id: "pw",
+				Path: "/"},
+		},
+		{
+			name: "ss legacy",
+			uri:  "ss://" + base64.StdEncoding.EncodeToString([]byte("aes-256-gcm:p@ss:w@1.2.3.4:8388")) + "#a%20b",
+			want: Link{Protocol: ProtocolShadowsocks, Network: NetworkTcp, Address: "1.2.3.4", Port: "8388",
+				Id: "p@ss:w", Method: "aes-256-gcm", Name: "a b"},
+		},
+		{
+			name: "ss sip002",
+			uri: "ss://" + base64.RawURLEncoding.EncodeToString([]byte("chacha20-ietf-poly1305:secret")) +
+				"@[2001:db8::1]:8388",
+			want: Link{Protocol: ProtocolShadowsocks, Network: NetworkTcp, Address: "2001:db8::1", Port: "8388",
+				Id: "secret", Method: "chacha20-poly1305"},
+		},
+		{
+			name: "hysteria2 port hopping",
+			uri:  "hy2://auth@h.example:443,5000-6000/?sni=s.example&insecure=1#n",
+			want: Link{Protocol: ProtocolHysteria2, Address: "h.example", Port: "443,5000-6000", Id: "auth",
+				Sni: "s.example", AllowInsecure: true, Name: "n",
+				Uri: "hysteria2://auth@h.example:443,5000-6000/?sni=s.example&insecure=1"},
+		},
+		{
+			name: "hysteria2 default port",
+			uri:  "hysteria2://auth@h.example",
+			want: Link{Protocol: ProtocolHysteria2, Address: "h.example", Id: "auth",
+				Uri: "hysteria2://auth@h.example"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := Parse(tt.uri)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			if *l != tt.want {
+				t.Errorf("Parse() = %+v, want %+v", *l, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		uri         string
+		unsupported bool
+	}{
+		{name: "no scheme", uri: "example.com:443"},
+		{name: "unknown scheme", uri: "http://x.example", unsupported: true},
+
+		{name: "vmess bad base64", uri: "vmess://!!!"},
+		{name: "vmess bad json", uri: "vmess://" + base64.StdEncoding.EncodeToString([]byte(`{"add":`))},
+		{name: "vmess missing host", uri: vmessLink(`{"port":443,"id":"` + testUuid + `","net":"ws","tls":"tls"}`)},
+		{name: "vmess missing port", uri: vmessLink(`{"add":"a.example","id":"` + testUuid +
+			`","net":"ws","tls":"tls"}`)},
+		{name: "vmess missing uuid", uri: vmessLink(`{"add":"a.example","port":443,"net":"ws","tls":"tls"}`)},
+		{name: "vmess bad uuid", uri: vmessLink(`{"add":"a.example","port":443,"id":"nope","net":"ws",` +
+			`"tls":"tls"}`)},
+		{name: "vmess ws without tls", uri: vmessLink(`{"add":"a.example","port":443,"id":"` + testUuid +
+			`","net":"ws"}`), unsupported: true},
+		{name: "vmess grpc", uri: vmessLink(`{"add":"a.example","port":443,"id":"` + testUuid +
+			`","net":"grpc","tls":"tls"}`), unsupported: true},
+		{name: "vmess quic other encryption", uri: vmessLink(`{"add":"a.example","port":443,"id":"` + testUuid +
+			`","net":"quic","type":"srtp","host":"chacha20-poly1305"}`), unsupported: true},
+
+		{name: "vless missing credentials", uri: "vless://x.example:443?type=ws&security=tls"},
+		{name: "vless missing host", uri: "vless://" + testUuid + "@:443?type=ws&security=tls"},
+		{name: "vless missing port", uri: "vless://" + testUuid + "@x.example?type=ws&security=tls"},
+		{name: "vless port out of range", uri: "vless://" + testUuid + "@x.example:70000?type=ws&security=tls"},
+		{name: "vless plain tcp", uri: "vless://" + testUuid + "@x.example:443?type=tcp&security=tls",
+			unsupported: true},
+		{name: "vless ws without tls", uri: "vless://" + testUuid + "@x.example:443?type=ws&security=none",
+			unsupported: true},
+		{name: "vless reality over ws", uri: "vless://" + testUuid + "@x.example:443?type=ws&security=reality",
+			unsupported: true},
+		{name: "vless reality over quic", uri: "vless://" + testUuid +
+			"@x.example:443?type=quic&headerType=srtp&security=reality", unsupported: true},
+		{name: "vless flow", uri: "vless://" + testUuid +
+			"@x.example:443?type=ws&security=tls&flow=xtls-rprx-vision", unsupported: true},
+		{name: "vless encryption", uri: "vless://" + testUuid + "@x.example:443?type=ws&security=tls&encryption=aes",
+			unsupported: true},
+		{name: "vless quic unknown header", uri: "vless://" + testUuid + "@x.example:443?type=quic&headerType=dtls",
+			unsupported: true},
+
+		{name: "trojan plain tcp", uri: "trojan://pw@x.example:443", unsupported: true},
+
+		{name: "ss bad base64", uri: "ss://!!!#n"},
+		{name: "ss missing password", uri: "ss://" + base64.StdEncoding.EncodeToString([]byte("aes-256-gcm@h:1"))},
+		{name: "ss missing port", uri: "ss://" + base64.StdEncoding.EncodeToString([]byte("aes-256-gcm:pw@h"))},
+		{name: "ss unknown cipher", uri: "ss://" + base64.StdEncoding.EncodeToString([]byte("rc4-md5:pw@h:1")),
+			unsupported: true},
+		{name: "ss plugin", uri: "ss://" + base64.RawURLEncoding.EncodeToString([]byte("aes-128-gcm:pw")) +
+			"@h.example:8388/?plugin=obfs-local", unsupported: true},
+
+		{name: "hysteria2 missing host", uri: "hysteria2://auth@:443"},
+		{name: "hysteria2 bad port range", uri: "hysteria2://auth@h.example:443-x"},
+		{name: "hysteria2 obfs", uri: "hysteria2://auth@h.example:443?obfs=other", unsupported: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := Parse(tt.uri)
+			if err == nil {
+				t.Fatalf("Parse() = %+v, want error", *l)
+			}
+
+			if errors.Is(err, ErrUnsupported) != tt.unsupported {
+				t.Errorf("Parse() error = %v, unsupported = %v", err, tt.unsupported)
+			}
+		})
+	}
+}
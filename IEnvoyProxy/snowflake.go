@@ -0,0 +1,513 @@
+package IEnvoyProxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+	utlsutil "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/utls"
+	sf "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/client/lib"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/event"
+	sqscreds "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/sqscreds/lib"
+)
+
+//goland:noinspection GoUnusedConst
+const (
+	// SnowflakeRendezvousDomainFronting - Rendezvous with the broker at `SnowflakeBrokerUrl`, domain fronted
+	// with `SnowflakeFrontDomains`, if given.
+	SnowflakeRendezvousDomainFronting = "domain_fronting"
+
+	// SnowflakeRendezvousAmpCache - Rendezvous with the broker at `SnowflakeBrokerUrl` through the AMP cache at
+	// `SnowflakeAmpCacheUrl`, domain fronted with `SnowflakeFrontDomains`, if given.
+	SnowflakeRendezvousAmpCache = "ampcache"
+
+	// SnowflakeRendezvousSqs - Rendezvous through the Amazon SQS queue at `SnowflakeSqsUrl` with
+	// `SnowflakeSqsCreds`.
+	SnowflakeRendezvousSqs = "sqs"
+)
+
+//goland:noinspection GoUnusedConst
+const (
+	// SnowflakeEventOffer - A WebRTC offer was created and is about to be sent to the broker, i.e. Snowflake is
+	// looking for a proxy. Comes with an error, if the offer could not be created.
+	SnowflakeEventOffer = "offer"
+
+	// SnowflakeEventRendezvous - The broker answered with a proxy. Comes with an error, if the broker could not be
+	// reached or had no proxy available.
+	SnowflakeEventRendezvous = "rendezvous"
+
+	// SnowflakeEventPeerConnected - The WebRTC connection to a proxy was established.
+	SnowflakeEventPeerConnected = "peer_connected"
+
+	// SnowflakeEventPeerFailed - The WebRTC connection to a proxy could not be established. Comes with an error.
+	SnowflakeEventPeerFailed = "peer_failed"
+
+	// SnowflakeEventPeerLost - An established WebRTC connection to a proxy broke down. Comes with an error.
+	SnowflakeEventPeerLost = "peer_lost"
+
+	// SnowflakeEventClosed - A connection through Snowflake was closed and its proxies released.
+	SnowflakeEventClosed = "closed"
+)
+
+// snowflakeDataChannelTimeout - The error Snowflake reports, when a proxy didn't open the data channel in time.
+// Its other connection failures concern established peers.
+const snowflakeDataChannelTimeout = "timeout waiting for DataChannel.OnOpen"
+
+// snowflakeRendezvousTimeout - How long to wait for a rendezvous method to get an answer from the broker, before
+// trying the next one.
+const snowflakeRendezvousTimeout = time.Minute
+
+// bridgeFingerprintPattern - A Tor relay fingerprint is the hex-encoded SHA-1 hash of its identity key.
+var bridgeFingerprintPattern = regexp.MustCompile(`^[0-9A-Fa-f]{40}$`)
+
+// sqsHostPattern - Snowflake extracts the AWS region from the SQS queue URL's host and exits, if that fails.
+var sqsHostPattern = regexp.MustCompile(`^sqs\.([\w-]+)\.amazonaws\.com$`)
+
+// snowflakeRendezvous - The rendezvous methods to try in order, as PT arguments for each.
+//
+// @throws if a rendezvous method is unknown or its settings are missing or invalid.
+func (c *Controller) snowflakeRendezvous(proxy string) ([]*pt.Args, error) {
+	var methods []string
+
+	if strings.TrimSpace(c.SnowflakeRendezvous) != "" {
+		for _, method := range strings.Split(c.SnowflakeRendezvous, ",") {
+			methods = append(methods, strings.ToLower(strings.TrimSpace(method)))
+		}
+	} else {
+		// Without explicit configuration, use what's configured, in the same order Snowflake prefers it.
+		if c.SnowflakeSqsUrl != "" {
+			methods = append(methods, SnowflakeRendezvousSqs)
+		}
+
+		if c.SnowflakeAmpCacheUrl != "" {
+			methods = append(methods, SnowflakeRendezvousAmpCache)
+		}
+
+		if c.SnowflakeBrokerUrl != "" {
+			methods = append(methods, SnowflakeRendezvousDomainFronting)
+		}
+
+		if len(methods) == 0 {
+			return nil, errors.New("no rendezvous method configured, set SnowflakeBrokerUrl or SnowflakeSqsUrl")
+		}
+	}
+
+	if c.SnowflakeUtlsImitate != "" {
+		if _, err := utlsutil.NameToUTLSID(c.SnowflakeUtlsImitate); err != nil {
+			return nil, fmt.Errorf("invalid SnowflakeUtlsImitate %q: %w", c.SnowflakeUtlsImitate, err)
+		}
+	} else if c.SnowflakeUtlsRemoveSni {
+		return nil, errors.New("SnowflakeUtlsRemoveSni needs SnowflakeUtlsImitate")
+	}
+
+	if c.SnowflakeFingerprint != "" && !bridgeFingerprintPattern.MatchString(c.SnowflakeFingerprint) {
+		return nil, fmt.Errorf("invalid SnowflakeFingerprint %q, needs to be 40 hex digits", c.SnowflakeFingerprint)
+	}
+
+	var rendezvous []*pt.Args
+
+	for _, method := range methods {
+		args := &pt.Args{}
+		args.Add("fronts", c.SnowflakeFrontDomains)
+		args.Add("ice", c.SnowflakeIceServers)
+		args.Add("max", strconv.Itoa(max(1, c.SnowflakeMaxPeers)))
+		args.Add("proxy", proxy)
+
+		if c.SnowflakeUtlsImitate != "" {
+			args.Add("utls-imitate", c.SnowflakeUtlsImitate)
+			args.Add("utls-nosni", strconv.FormatBool(c.SnowflakeUtlsRemoveSni))
+		}
+
+		if c.SnowflakeFingerprint != "" {
+			args.Add("fingerprint", c.SnowflakeFingerprint)
+		}
+
+		if c.SnowflakeKeepLocalAddresses {
+			args.Add("keep-local-addresses", "true")
+		}
+
+		switch method {
+		case SnowflakeRendezvousDomainFronting:
+			if err := checkSnowflakeUrl("SnowflakeBrokerUrl", c.SnowflakeBrokerUrl); err != nil {
+				return nil, fmt.Errorf("%s rendezvous: %w", method, err)
+			}
+
+			args.Add("url", c.SnowflakeBrokerUrl)
+
+		case SnowflakeRendezvousAmpCache:
+			if err := checkSnowflakeUrl("SnowflakeBrokerUrl", c.SnowflakeBrokerUrl); err != nil {
+				return nil, fmt.Errorf("%s rendezvous: %w", method, err)
+			}
+
+			if err := checkSnowflakeUrl("SnowflakeAmpCacheUrl", c.SnowflakeAmpCacheUrl); err != nil {
+				return nil, fmt.Errorf("%s rendezvous: %w", method, err)
+			}
+
+			args.Add("url", c.SnowflakeBrokerUrl)
+			args.Add("ampcache", c.SnowflakeAmpCacheUrl)
+
+		case SnowflakeRendezvousSqs:
+			if err := checkSnowflakeUrl("SnowflakeSqsUrl", c.SnowflakeSqsUrl); err != nil {
+				return nil, fmt.Errorf("%s rendezvous: %w", method, err)
+			}
+
+			u, _ := url.Parse(c.SnowflakeSqsUrl)
+			if !sqsHostPattern.MatchString(u.Hostname()) {
+				return nil, fmt.Errorf("%s rendezvous: SnowflakeSqsUrl needs a host like sqs.<region>.amazonaws.com",
+					method)
+			}
+
+			if c.SnowflakeSqsCreds == "" {
+				return nil, fmt.Errorf("%s rendezvous: SnowflakeSqsCreds missing", method)
+			}
+
+			if _, err := sqscreds.AwsCredsFromBase64(c.SnowflakeSqsCreds); err != nil {
+				return nil, fmt.Errorf("%s rendezvous: invalid SnowflakeSqsCreds: %w", method, err)
+			}
+
+			// Snowflake exits, when SQS is combined with another method, so don't pass the broker URL.
+			args.Add("sqsqueue", c.SnowflakeSqsUrl)
+			args.Add("sqscreds", c.SnowflakeSqsCreds)
+
+		default:
+			return nil, fmt.Errorf("unknown rendezvous method %q, use %q, %q or %q", method,
+				SnowflakeRendezvousDomainFronting, SnowflakeRendezvousAmpCache, SnowflakeRendezvousSqs)
+		}
+
+		rendezvous = append(rendezvous, args)
+	}
+
+	if err := sharedResolver.checkBypass(c.snowflakeDomains(methods)); err != nil {
+		return nil, fmt.Errorf("snowflake resolves its broker, front and ICE server domains itself: %w", err)
+	}
+
+	return rendezvous, nil
+}
+
+// snowflakeDomains - The domains Snowflake resolves with the system resolver for the given rendezvous methods.
+func (c *Controller) snowflakeDomains(methods []string) []string {
+	var domains []string
+
+	hostname := func(rawUrl string) {
+		if u, err := url.Parse(rawUrl); err == nil && u.Hostname() != "" {
+			domains = append(domains, u.Hostname())
+		}
+	}
+
+	for _, method := range methods {
+		switch method {
+		case SnowflakeRendezvousSqs:
+			hostname(c.SnowflakeSqsUrl)
+
+		default:
+			hostname(c.SnowflakeBrokerUrl)
+
+			if method == SnowflakeRendezvousAmpCache {
+				hostname(c.SnowflakeAmpCacheUrl)
+			}
+
+			for _, front := range strings.Split(c.SnowflakeFrontDomains, ",") {
+				if front = strings.TrimSpace(front); front != "" {
+					domains = append(domains, front)
+				}
+			}
+		}
+	}
+
+	// Like "stun:stun.example.com:3478" or "turn:turn.example.com?transport=tcp".
+	for _, ice := range strings.Split(c.SnowflakeIceServers, ",") {
+		_, server, _ := strings.Cut(strings.TrimSpace(ice), ":")
+		server, _, _ = strings.Cut(server, "?")
+
+		if host, _, err := net.SplitHostPort(server); err == nil {
+			server = host
+		}
+
+		if server != "" && net.ParseIP(server) == nil {
+			domains = append(domains, server)
+		}
+	}
+
+	return domains
+}
+
+// checkSnowflakeUrl - Check, that a Snowflake setting is an absolute HTTP(S) URL.
+func checkSnowflakeUrl(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s missing", name)
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid %s %q, needs to be an HTTP(S) URL", name, value)
+	}
+
+	return nil
+}
+
+// snowflakeFactory - Wraps Lyrebird's Snowflake client factory to try several rendezvous methods in order.
+//
+// The first method which gets an answer from the broker is used for all following connections.
+type snowflakeFactory struct {
+	base.ClientFactory
+
+	rendezvous []*pt.Args
+	selected   atomic.Int32
+
+	// events - Optional delegate to forward Snowflake's events to.
+	events OnSnowflakeEvent
+
+	// peers - Number of connected proxies over all connections.
+	peers atomic.Int32
+}
+
+// ParseArgs - Parse the arguments for each rendezvous method.
+//
+// Arguments given by the client take precedence, like with all other transports.
+func (f *snowflakeFactory) ParseArgs(args *pt.Args) (interface{}, error) {
+	var configs []sf.ClientConfig
+
+	for _, rendezvous := range f.rendezvous {
+		merged := pt.Args{}
+
+		for name, values := range *args {
+			merged[name] = values
+		}
+
+		addExtraArgs(&merged, rendezvous)
+
+		// Snowflake exits instead of returning an error on these.
+		if queue, _ := merged.Get("sqsqueue"); queue != "" {
+			broker, _ := merged.Get("url")
+			ampCache, _ := merged.Get("ampcache")
+			creds, _ := merged.Get("sqscreds")
+
+			if broker != "" || ampCache != "" || creds == "" {
+				return nil, errors.New("SQS rendezvous needs sqscreds and cannot be combined with url or ampcache")
+			}
+		}
+
+		config, err := f.ClientFactory.ParseArgs(&merged)
+		if err != nil {
+			return nil, err
+		}
+
+		sfConfig := config.(sf.ClientConfig)
+
+		// Lyrebird doesn't know this one.
+		if arg, ok := merged.Get("keep-local-addresses"); ok {
+			switch strings.ToLower(arg) {
+			case "true", "yes":
+				sfConfig.KeepLocalAddresses = true
+			}
+		}
+
+		configs = append(configs, sfConfig)
+	}
+
+	return configs, nil
+}
+
+// Dial - Connect using the selected rendezvous method. If the broker cannot be reached with it, try the next ones.
+func (f *snowflakeFactory) Dial(network, address string, dialFn base.DialFunc, args interface{}) (net.Conn, error) {
+	configs, ok := args.([]sf.ClientConfig)
+	if !ok {
+		return nil, errors.New("invalid type for args")
+	}
+
+	var err error
+	first := int(f.selected.Load())
+
+	for i := range configs {
+		index := (first + i) % len(configs)
+		last := i == len(configs)-1
+
+		var conn net.Conn
+
+		conn, err = f.dialSnowflake(configs[index], !last)
+		if err == nil {
+			f.selected.Store(int32(index))
+
+			return conn, nil
+		}
+
+		ptlog.Warnf("Snowflake: Rendezvous method %d of %d failed: %s", index+1, len(configs),
+			ptlog.ElideError(err))
+	}
+
+	return nil, err
+}
+
+// dialSnowflake - Connect with the given configuration.
+//
+// @param awaitRendezvous Wait for the broker's answer to the first offer, to be able to fall back to another
+// rendezvous method. Otherwise, Snowflake keeps retrying in the background.
+//
+// @throws if Snowflake cannot be initialized or, if awaited, the rendezvous fails or times out.
+func (f *snowflakeFactory) dialSnowflake(config sf.ClientConfig, awaitRendezvous bool) (net.Conn, error) {
+	transport, err := sf.NewSnowflakeClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var events *snowflakeEventListener
+
+	if f.events != nil {
+		events = &snowflakeEventListener{factory: f}
+		transport.AddSnowflakeEventListener(events)
+	}
+
+	rendezvous := &rendezvousListener{result: make(chan error, 1)}
+
+	if awaitRendezvous {
+		transport.AddSnowflakeEventListener(rendezvous)
+	}
+
+	conn, err := transport.Dial()
+	if err != nil {
+		events.release()
+
+		return nil, err
+	}
+
+	if events != nil {
+		conn = &snowflakeConn{Conn: conn, events: events}
+	}
+
+	if !awaitRendezvous {
+		return conn, nil
+	}
+
+	select {
+	case err = <-rendezvous.result:
+	case <-time.After(snowflakeRendezvousTimeout):
+		err = errors.New("no answer from broker")
+	}
+
+	transport.RemoveSnowflakeEventListener(rendezvous)
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// rendezvousListener - Reports the result of the first broker rendezvous.
+type rendezvousListener struct {
+	result chan error
+}
+
+// OnNewSnowflakeEvent - Implements `event.SnowflakeEventReceiver`.
+func (l *rendezvousListener) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	if e, ok := e.(event.EventOnBrokerRendezvous); ok {
+		// Must not block.
+		select {
+		case l.result <- e.Error:
+		default:
+		}
+	}
+}
+
+// snowflakeEventListener - Forwards the events of one Snowflake connection to the `OnSnowflakeEvent` delegate.
+type snowflakeEventListener struct {
+	factory *snowflakeFactory
+
+	// peers - Number of connected proxies of this connection.
+	peers int32
+
+	// closed - Snowflake's goroutines might still report, after the connection was closed.
+	closed bool
+	mutex  sync.Mutex
+}
+
+// OnNewSnowflakeEvent - Implements `event.SnowflakeEventReceiver`.
+func (l *snowflakeEventListener) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	switch e := e.(type) {
+	case event.EventOnOfferCreated:
+		l.forward(SnowflakeEventOffer, 0, e.Error)
+
+	case event.EventOnBrokerRendezvous:
+		l.forward(SnowflakeEventRendezvous, 0, e.Error)
+
+	case event.EventOnSnowflakeConnected:
+		l.forward(SnowflakeEventPeerConnected, 1, nil)
+
+	case event.EventOnSnowflakeConnectionFailed:
+		if e.Error != nil && e.Error.Error() == snowflakeDataChannelTimeout {
+			l.forward(SnowflakeEventPeerFailed, 0, e.Error)
+		} else {
+			l.forward(SnowflakeEventPeerLost, -1, e.Error)
+		}
+	}
+}
+
+// forward - Update the number of connected proxies and call the delegate.
+//
+// @param delta Change of the number of connected proxies of this connection.
+func (l *snowflakeEventListener) forward(kind string, delta int32, err error) {
+	l.mutex.Lock()
+
+	if l.closed {
+		l.mutex.Unlock()
+		return
+	}
+
+	// Snowflake doesn't tell, which peer broke down, so never count below what this connection added.
+	delta = max(delta, -l.peers)
+	l.peers += delta
+	peers := l.factory.peers.Add(delta)
+
+	l.mutex.Unlock()
+
+	l.factory.events.SnowflakeEvent(kind, int(peers), newTransportError(Snowflake, "", err))
+}
+
+// release - Remove the proxies of this connection from the count, as Snowflake closes them without events.
+func (l *snowflakeEventListener) release() {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+
+	peers := l.factory.peers.Add(-l.peers)
+	l.peers = 0
+	l.closed = true
+
+	l.mutex.Unlock()
+
+	l.factory.events.SnowflakeEvent(SnowflakeEventClosed, int(peers), nil)
+}
+
+// snowflakeConn - Reports closing of a Snowflake connection.
+type snowflakeConn struct {
+	net.Conn
+
+	events *snowflakeEventListener
+	once   sync.Once
+}
+
+// Close - Close the connection and report its proxies as released.
+func (c *snowflakeConn) Close() error {
+	err := c.Conn.Close()
+
+	c.once.Do(c.events.release)
+
+	return err
+}
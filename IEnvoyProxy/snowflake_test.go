@@ -0,0 +1,502 @@
+package IEnvoyProxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports"
+	sf "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/client/lib"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/event"
+	sqscreds "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/sqscreds/lib"
+)
+
+const testBridgeFingerprint = "2B280B23E1107BB62ABFC40DDCC8824814F80A72"
+
+const testSqsUrl = "https://sqs.us-east-1.amazonaws.com/123456789012/snowflake"
+
+func testSqsCreds(t *testing.T) string {
+	t.Helper()
+
+	creds, err := sqscreds.AwsCreds{AwsAccessKeyId: "id", AwsSecretKey: "secret"}.Base64()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return creds
+}
+
+func TestSnowflakeRendezvous(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	c.SnowflakeBrokerUrl = "https://broker.example/"
+	c.SnowflakeAmpCacheUrl = "https://amp.example/"
+	c.SnowflakeSqsUrl = testSqsUrl
+	c.SnowflakeSqsCreds = testSqsCreds(t)
+
+	methods := func() []string {
+		t.Helper()
+
+		rendezvous, err := c.snowflakeRendezvous("")
+		if err != nil {
+			t.Fatalf("snowflakeRendezvous() error = %v", err)
+		}
+
+		var methods []string
+
+		for _, args := range rendezvous {
+			queue, _ := args.Get("sqsqueue")
+			ampCache, _ := args.Get("ampcache")
+
+			switch {
+			case queue != "":
+				methods = append(methods, SnowflakeRendezvousSqs)
+
+			case ampCache != "":
+				methods = append(methods, SnowflakeRendezvousAmpCache)
+
+			default:
+				methods = append(methods, SnowflakeRendezvousDomainFronting)
+			}
+		}
+
+		return methods
+	}
+
+	// Snowflake's own preference, if not configured.
+	if got := strings.Join(methods(), ","); got != "sqs,ampcache,domain_fronting" {
+		t.Errorf("default order = %s", got)
+	}
+
+	c.SnowflakeRendezvous = " Domain_Fronting, sqs "
+
+	if got := strings.Join(methods(), ","); got != "domain_fronting,sqs" {
+		t.Errorf("configured order = %s", got)
+	}
+}
+
+func TestSnowflakeRendezvousErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(c *Controller)
+		want   string
+	}{
+		{name: "nothing configured", config: func(c *Controller) {}, want: "no rendezvous method"},
+		{name: "unknown method", config: func(c *Controller) {
+			c.SnowflakeRendezvous = "carrier_pigeon"
+		}, want: "unknown rendezvous method"},
+		{name: "broker missing", config: func(c *Controller) {
+			c.SnowflakeRendezvous = SnowflakeRendezvousDomainFronting
+		}, want: "SnowflakeBrokerUrl missing"},
+		{name: "broker not http", config: func(c *Controller) {
+			c.SnowflakeBrokerUrl = "ftp://broker.example/"
+		}, want: "invalid SnowflakeBrokerUrl"},
+		{name: "amp cache relative", config: func(c *Controller) {
+			c.SnowflakeBrokerUrl = "https://broker.example/"
+			c.SnowflakeRendezvous = SnowflakeRendezvousAmpCache
+			c.SnowflakeAmpCacheUrl = "/amp"
+		}, want: "invalid SnowflakeAmpCacheUrl"},
+		{name: "sqs host", config: func(c *Controller) {
+			c.SnowflakeSqsUrl = "https://queue.example/snowflake"
+		}, want: "sqs.<region>.amazonaws.com"},
+		{name: "sqs creds missing", config: func(c *Controller) {
+			c.SnowflakeSqsUrl = testSqsUrl
+		}, want: "SnowflakeSqsCreds missing"},
+		{name: "sqs creds invalid", config: func(c *Controller) {
+			c.SnowflakeSqsUrl = testSqsUrl
+			c.SnowflakeSqsCreds = "not base64!"
+		}, want: "invalid SnowflakeSqsCreds"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewController(t.TempDir(), false, false, "ERROR", nil)
+			tt.config(c)
+
+			_, err := c.snowflakeRendezvous("")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("snowflakeRendezvous() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// rendezvousRecorder - A front domain for the fake broker and AMP cache, which records the order they're asked
+// in and fails all requests.
+type rendezvousRecorder struct {
+	mutex sync.Mutex
+	order []string
+	seen  chan string
+}
+
+func (r *rendezvousRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := SnowflakeRendezvousDomainFronting
+	if strings.HasSuffix(req.Host, "amp.example") {
+		name = SnowflakeRendezvousAmpCache
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.order) == 0 || r.order[len(r.order)-1] != name {
+		r.order = append(r.order, name)
+
+		select {
+		case r.seen <- name:
+		default:
+		}
+	}
+
+	http.Error(w, "go away", http.StatusServiceUnavailable)
+}
+
+func TestSnowflakeRendezvousFallback(t *testing.T) {
+	for _, order := range []string{"ampcache,domain_fronting", "domain_fronting,ampcache"} {
+		t.Run(order, func(t *testing.T) {
+			rec := &rendezvousRecorder{seen: make(chan string, 10)}
+			front := httptest.NewServer(rec)
+			defer front.Close()
+
+			c := NewController(t.TempDir(), false, false, "ERROR", nil)
+			c.SnowflakeRendezvous = order
+			c.SnowflakeBrokerUrl = "http://broker.example/"
+			c.SnowflakeAmpCacheUrl = "http://amp.example/"
+			c.SnowflakeFrontDomains = front.Listener.Addr().String()
+
+			rendezvous, err := c.snowflakeRendezvous("")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			factory, err := transports.Get(Snowflake).ClientFactory(c.stateDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f := &snowflakeFactory{ClientFactory: factory, rendezvous: rendezvous}
+
+			args, err := f.ParseArgs(&pt.Args{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The first method fails, the last one isn't awaited.
+			conn, err := f.Dial("tcp", "", nil, args)
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+
+			defer func() {
+				_ = conn.Close()
+			}()
+
+			for range rendezvous {
+				select {
+				case <-rec.seen:
+				case <-time.After(10 * time.Second):
+					t.Fatal("rendezvous server not contacted")
+				}
+			}
+
+			rec.mutex.Lock()
+			got := strings.Join(rec.order[:2], ",")
+			rec.mutex.Unlock()
+
+			if got != order {
+				t.Errorf("rendezvous order = %s, want %s", got, order)
+			}
+
+			if f.selected.Load() != 1 {
+				t.Errorf("selected = %d, want the second method", f.selected.Load())
+			}
+
+			// The next connection starts with the method which worked last.
+			rec.mutex.Lock()
+			rec.order = nil
+			rec.mutex.Unlock()
+
+			conn2, err := f.Dial("tcp", "", nil, args)
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+
+			defer func() {
+				_ = conn2.Close()
+			}()
+
+			select {
+			case <-rec.seen:
+			case <-time.After(10 * time.Second):
+				t.Fatal("rendezvous server not contacted")
+			}
+
+			rec.mutex.Lock()
+			first := rec.order[0]
+			rec.mutex.Unlock()
+
+			if want := strings.Split(order, ",")[1]; first != want {
+				t.Errorf("second connection started with %s, want %s", first, want)
+			}
+		})
+	}
+}
+
+// snowflakeEventRecorder - Records the events passed to an `OnSnowflakeEvent` delegate.
+type snowflakeEventRecorder struct {
+	events []string
+}
+
+func (r *snowflakeEventRecorder) SnowflakeEvent(kind string, peers int, error error) {
+	r.events = append(r.events, fmt.Sprintf("%s %d %v", kind, peers, error))
+}
+
+func TestSnowflakeEvents(t *testing.T) {
+	rec := &snowflakeEventRecorder{}
+	f := &snowflakeFactory{events: rec}
+	first := &snowflakeEventListener{factory: f}
+	second := &snowflakeEventListener{factory: f}
+
+	noProxy := errors.New("no proxy")
+	timeout := errors.New(snowflakeDataChannelTimeout)
+	broken := errors.New("connection reset")
+
+	first.OnNewSnowflakeEvent(event.EventOnOfferCreated{})
+	first.OnNewSnowflakeEvent(event.EventOnBrokerRendezvous{Error: noProxy})
+	first.OnNewSnowflakeEvent(event.EventOnSnowflakeConnected{})
+	first.OnNewSnowflakeEvent(event.EventOnSnowflakeConnected{})
+	first.OnNewSnowflakeEvent(event.EventOnSnowflakeConnectionFailed{Error: timeout})
+	first.OnNewSnowflakeEvent(event.EventOnSnowflakeConnectionFailed{Error: broken})
+	second.OnNewSnowflakeEvent(event.EventOnSnowflakeConnected{})
+	first.OnNewSnowflakeEvent(event.EventOnSnowflakeConnectionFailed{Error: broken})
+	first.OnNewSnowflakeEvent(event.EventOnSnowflakeConnectionFailed{Error: broken})
+	second.OnNewSnowflakeEvent(event.EventOnProxyStarting{})
+	second.release()
+	second.OnNewSnowflakeEvent(event.EventOnSnowflakeConnected{})
+
+	want := []string{
+		"offer 0 <nil>",
+		"rendezvous 0 [unknown] snowflake: no proxy",
+		"peer_connected 1 <nil>",
+		"peer_connected 2 <nil>",
+		"peer_failed 2 [timeout] snowflake: " + snowflakeDataChannelTimeout,
+		"peer_lost 1 [connection] snowflake: connection reset",
+		"peer_connected 2 <nil>",
+		"peer_lost 1 [connection] snowflake: connection reset",
+		// The first connection has no peers left, so this one must have been lost before it was counted.
+		"peer_lost 1 [connection] snowflake: connection reset",
+		"closed 0 <nil>",
+	}
+
+	if strings.Join(rec.events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events:\n%s\nwant:\n%s", strings.Join(rec.events, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSnowflakeArgs(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	c.SnowflakeBrokerUrl = "https://broker.example/"
+	c.SnowflakeAmpCacheUrl = "https://amp.example/"
+	c.SnowflakeRendezvous = "ampcache, domain_fronting"
+	c.SnowflakeUtlsImitate = "hellochrome_auto"
+	c.SnowflakeUtlsRemoveSni = true
+	c.SnowflakeFingerprint = testBridgeFingerprint
+	c.SnowflakeKeepLocalAddresses = true
+
+	rendezvous, err := c.snowflakeRendezvous("")
+	if err != nil {
+		t.Fatalf("snowflakeRendezvous() error = %v", err)
+	}
+
+	rec := &fakeFactory{config: sf.ClientConfig{}}
+	f := &snowflakeFactory{ClientFactory: rec, rendezvous: rendezvous}
+
+	args, err := f.ParseArgs(&pt.Args{})
+	if err != nil {
+		t.Fatalf("ParseArgs() error = %v", err)
+	}
+
+	if len(rec.args) != 2 {
+		t.Fatalf("ParseArgs() called %d times, want once per rendezvous method", len(rec.args))
+	}
+
+	want := map[string]string{
+		"utls-imitate":         "hellochrome_auto",
+		"utls-nosni":           "true",
+		"fingerprint":          testBridgeFingerprint,
+		"keep-local-addresses": "true",
+		"url":                  "https://broker.example/",
+	}
+
+	for i, parsed := range rec.args {
+		for name, value := range want {
+			if got, _ := parsed.Get(name); got != value {
+				t.Errorf("rendezvous %d: %s = %q, want %q", i, name, got, value)
+			}
+		}
+	}
+
+	if got, _ := rec.args[0].Get("ampcache"); got != "https://amp.example/" {
+		t.Errorf("rendezvous 0: ampcache = %q", got)
+	}
+
+	if _, ok := rec.args[1].Get("ampcache"); ok {
+		t.Error("rendezvous 1: unexpected ampcache")
+	}
+
+	for i, config := range args.([]sf.ClientConfig) {
+		if !config.KeepLocalAddresses {
+			t.Errorf("rendezvous %d: KeepLocalAddresses not set", i)
+		}
+	}
+}
+
+func TestSnowflakeArgsClientOverrides(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	c.SnowflakeBrokerUrl = "https://broker.example/"
+	c.SnowflakeFingerprint = testBridgeFingerprint
+
+	rendezvous, err := c.snowflakeRendezvous("")
+	if err != nil {
+		t.Fatalf("snowflakeRendezvous() error = %v", err)
+	}
+
+	rec := &fakeFactory{config: sf.ClientConfig{}}
+	f := &snowflakeFactory{ClientFactory: rec, rendezvous: rendezvous}
+
+	override := "8838024498816A039FCBBAB14E6F40A0843051FA"
+
+	if _, err = f.ParseArgs(&pt.Args{"fingerprint": []string{override}}); err != nil {
+		t.Fatalf("ParseArgs() error = %v", err)
+	}
+
+	if got, _ := rec.args[0].Get("fingerprint"); got != override {
+		t.Errorf("fingerprint = %q, want the client's %q", got, override)
+	}
+}
+
+func TestSnowflakeArgsErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(c *Controller)
+	}{
+		{"bad fingerprint", func(c *Controller) {
+			c.SnowflakeFingerprint = "2B280B23E1107BB62ABFC40DDCC8824814F80A7"
+		}},
+		{"non-hex fingerprint", func(c *Controller) {
+			c.SnowflakeFingerprint = "ZB280B23E1107BB62ABFC40DDCC8824814F80A72"
+		}},
+		{"nosni without imitate", func(c *Controller) {
+			c.SnowflakeUtlsRemoveSni = true
+		}},
+		{"unknown imitate", func(c *Controller) {
+			c.SnowflakeUtlsImitate = "netscape"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewController(t.TempDir(), false, false, "ERROR", nil)
+			c.SnowflakeBrokerUrl = "https://broker.example/"
+			tt.configure(c)
+
+			err := c.Start(Snowflake, "")
+			if err == nil {
+				c.Stop(Snowflake)
+				t.Fatal("Start() succeeded, want error")
+			}
+
+			if kind := ErrorKind(err); kind != ErrorKindConfig {
+				t.Errorf("ErrorKind() = %q, want %q: %v", kind, ErrorKindConfig, err)
+			}
+		})
+	}
+}
+
+func TestSnowflakeDomains(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	c.SnowflakeBrokerUrl = "https://broker.example/"
+	c.SnowflakeAmpCacheUrl = "https://amp.example/"
+	c.SnowflakeSqsUrl = "https://sqs.us-east-1.amazonaws.com/123/queue"
+	c.SnowflakeFrontDomains = "front1.example, front2.example"
+	c.SnowflakeIceServers = "stun:stun.example:3478,turn:turn.example?transport=tcp,stun:192.0.2.1:3478"
+
+	tests := []struct {
+		methods []string
+		want    []string
+	}{
+		{[]string{SnowflakeRendezvousDomainFronting},
+			[]string{"broker.example", "front1.example", "front2.example", "stun.example", "turn.example"}},
+		{[]string{SnowflakeRendezvousAmpCache},
+			[]string{"broker.example", "amp.example", "front1.example", "front2.example", "stun.example",
+				"turn.example"}},
+		{[]string{SnowflakeRendezvousSqs}, []string{"sqs.us-east-1.amazonaws.com", "stun.example", "turn.example"}},
+	}
+
+	for _, tt := range tests {
+		if got := c.snowflakeDomains(tt.methods); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("snowflakeDomains(%v) = %v, want %v", tt.methods, got, tt.want)
+		}
+	}
+}
+
+func TestSnowflakeRefusesPinnedDomains(t *testing.T) {
+	for _, domain := range []string{"broker.example", "front.example", "stun.example"} {
+		t.Run(domain, func(t *testing.T) {
+			c := NewController(t.TempDir(), false, false, "ERROR", nil)
+			c.SnowflakeBrokerUrl = "https://broker.example/"
+			c.SnowflakeFrontDomains = "front.example"
+			c.SnowflakeIceServers = "stun:stun.example:3478"
+
+			if err := c.PinDomainIPs(domain, "192.0.2.1"); err != nil {
+				t.Fatal(err)
+			}
+
+			defer c.UnpinDomain(domain)
+
+			err := c.Start(Snowflake, "")
+			if err == nil {
+				c.Stop(Snowflake)
+				t.Fatal("Start() succeeded, want error")
+			}
+
+			if kind := ErrorKind(err); kind != ErrorKindConfig || !strings.Contains(err.Error(), domain) {
+				t.Errorf("Start() error = %v, want %s error about %s", err, ErrorKindConfig, domain)
+			}
+		})
+	}
+}
+
+func TestSnowflakeRefusesDnsResolvers(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+	c.SnowflakeBrokerUrl = "https://broker.example/"
+
+	if err := c.AddDnsResolver("tls://dns.example:853", "192.0.2.53"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.ClearDnsResolvers()
+
+	err := c.Start(Snowflake, "")
+	if err == nil {
+		c.Stop(Snowflake)
+		t.Fatal("Start() succeeded, want error")
+	}
+
+	if kind := ErrorKind(err); kind != ErrorKindConfig {
+		t.Errorf("ErrorKind() = %q, want %q: %v", kind, ErrorKindConfig, err)
+	}
+
+	c.SetDnsSystemFallback(true)
+	defer c.SetDnsSystemFallback(false)
+
+	if err = c.Start(Snowflake, ""); err != nil {
+		t.Fatalf("Start() with system fallback error = %v", err)
+	}
+
+	c.Stop(Snowflake)
+}
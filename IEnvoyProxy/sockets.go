@@ -0,0 +1,99 @@
+package IEnvoyProxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// maxSocketPathLength - `sun_path` is 104 bytes on Darwin and 108 on Linux, including the terminating NUL.
+const maxSocketPathLength = 103
+
+// SetListenUnixSocket - Listen on a Unix domain socket inside `StateDir` instead of a TCP port on loopback,
+// so other apps on the device cannot use the transport.
+//
+// The socket is only accessible by the app itself (mode 0600, in a directory with mode 0700).
+// Fetch its path with `LocalSocketPath` after starting the transport.
+//
+// Takes effect with the next `Start` of the given transport. Overrides `SetListenAddress` and vice versa.
+//
+// @param methodName one of the constants `Obfs4`, `MeekLite`, `Webtunnel`, `Snowflake`, `Obfs4TubeSocks`,
+// `MeekLiteTubeSocks`, `V2RayWs`, `V2RaySrtp`, `V2RayWechat` or `V2RayShadowsocks`. `Hysteria2` is not supported.
+//
+// @param enabled true to listen on a Unix domain socket, false to listen on TCP again.
+//
+// @throws if the transport doesn't support Unix domain sockets or if `StateDir` is too long to contain a socket.
+func (c *Controller) SetListenUnixSocket(methodName string, enabled bool) error {
+	if !enabled {
+		if la, ok := c.listenAddresses[methodName]; ok && la.socket != "" {
+			delete(c.listenAddresses, methodName)
+		}
+
+		return nil
+	}
+
+	if methodName == Hysteria2 {
+		return fmt.Errorf("%s does not support Unix domain sockets", methodName)
+	}
+
+	path := filepath.Join(c.stateDir, "sockets", methodName+".sock")
+
+	if len(path) > maxSocketPathLength {
+		return fmt.Errorf("socket path %s is longer than %d bytes, use a shorter state directory", path,
+			maxSocketPathLength)
+	}
+
+	c.listenAddresses[methodName] = listenAddress{socket: path}
+
+	return nil
+}
+
+// LocalSocketPath - Path of the Unix domain socket the given transport listens on.
+//
+// @param methodName one of the constants given to `SetListenUnixSocket`.
+//
+// @returns the path of the socket or an empty string, if the transport is not running or listens on TCP.
+func (c *Controller) LocalSocketPath(methodName string) string {
+	return c.sockets[methodName]
+}
+
+// prepareSocket - Create the directory for a Unix domain socket and remove a stale socket left over from a crash.
+func prepareSocket(path string) error {
+	dir := filepath.Dir(path)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// MkdirAll doesn't touch existing directories.
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// listenUnix - Listen on a Unix domain socket only accessible by the app itself.
+func listenUnix(path string) (net.Listener, error) {
+	if err := prepareSocket(path); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Chmod(path, 0600); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
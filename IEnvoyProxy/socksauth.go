@@ -0,0 +1,134 @@
+package IEnvoyProxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+)
+
+// socksCredentials - Username and password required on a local SOCKS5 listener.
+type socksCredentials struct {
+	username string
+	password string
+}
+
+// SetSocksCredentials - Require SOCKS5 username/password authentication (RFC 1929) on the local listener of the
+// given transport, so other apps on the device cannot use it.
+//
+// Lyrebird (`Obfs4`, `MeekLite`, `Webtunnel`) and `Snowflake` don't support this, as they receive PT arguments in
+// the SOCKS5 username and password fields, like from Tor. Use `Obfs4TubeSocks` or `MeekLiteTubeSocks` instead.
+//
+// Takes effect with the next `Start` of the given transport.
+//
+// @param methodName one of the constants `Obfs4TubeSocks`, `MeekLiteTubeSocks`, `V2RayWs`, `V2RaySrtp`,
+// `V2RayWechat`, `V2RayShadowsocks` or `Hysteria2`.
+//
+// @param username The username to require. Empty to not require authentication, which is the default.
+//
+// @param password The password to require.
+//
+// @throws if the transport doesn't support authentication, if only one of username and password is given or if they
+// are too long.
+func (c *Controller) SetSocksCredentials(methodName, username, password string) error {
+	switch methodName {
+	case Obfs4, MeekLite, Webtunnel, Snowflake:
+		return fmt.Errorf("%s does not support SOCKS5 authentication, as it receives PT arguments instead", methodName)
+	}
+
+	if username == "" && password == "" {
+		delete(c.credentials, methodName)
+
+		return nil
+	}
+
+	if username == "" || password == "" {
+		return fmt.Errorf("%s: SOCKS5 username and password both need to be set", methodName)
+	}
+
+	// RFC 1929 limit.
+	if len(username) > 100 || len(password) > 100 {
+		return fmt.Errorf("%s: SOCKS5 username and password may not be longer than 100 bytes", methodName)
+	}
+
+	c.credentials[methodName] = &socksCredentials{username, password}
+
+	return nil
+}
+
+// GenerateSocksCredentials - Require SOCKS5 username/password authentication on the local listener of the given
+// transport with random credentials.
+//
+// Fetch them with `SocksUsername` and `SocksPassword`. See `SetSocksCredentials` for details.
+//
+// @param methodName one of the constants given to `SetSocksCredentials`.
+//
+// @throws if the transport doesn't support authentication or if no random numbers are available.
+func (c *Controller) GenerateSocksCredentials(methodName string) error {
+	username, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+
+	password, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+
+	return c.SetSocksCredentials(methodName, username, password)
+}
+
+// SocksUsername - The username required on the local SOCKS5 listener of the given transport.
+//
+// @param methodName one of the constants given to `SetSocksCredentials`.
+//
+// @returns the username or an empty string, if no authentication is required.
+func (c *Controller) SocksUsername(methodName string) string {
+	if creds, ok := c.credentials[methodName]; ok {
+		return creds.username
+	}
+
+	return ""
+}
+
+// SocksPassword - The password required on the local SOCKS5 listener of the given transport.
+//
+// @param methodName one of the constants given to `SetSocksCredentials`.
+//
+// @returns the password or an empty string, if no authentication is required.
+func (c *Controller) SocksPassword(methodName string) string {
+	if creds, ok := c.credentials[methodName]; ok {
+		return creds.password
+	}
+
+	return ""
+}
+
+// randomHex - n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Valid - Check given credentials in constant time. Implements `tubesocks.CredentialStore`.
+func (sc *socksCredentials) Valid(username, password string) bool {
+	u := subtle.ConstantTimeCompare([]byte(username), []byte(sc.username))
+	p := subtle.ConstantTimeCompare([]byte(password), []byte(sc.password))
+
+	return u&p == 1
+}
+
+// splitArgs - Split PT arguments into SOCKS5 username and password the way goptlib expects them.
+func splitArgs(args string) (string, string) {
+	if len(args) <= 255 {
+		// Tor sends NUL, if there's nothing left for the password, which has to be at least 1 byte long.
+		return args, "\x00"
+	}
+
+	return args[:255], args[255:]
+}
@@ -0,0 +1,99 @@
+package IEnvoyProxy
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+	"golang.org/x/net/proxy"
+)
+
+func TestSetSocksCredentials(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  bool
+	}{
+		{"both", "user", "pass", false},
+		{"none", "", "", false},
+		{"username only", "user", "", true},
+		{"password only", "", "pass", true},
+		{"too long", "user", string(make([]byte, 101)), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.SetSocksCredentials(V2RayWs, tt.username, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetSocksCredentials() error = %v, wantErr %t", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && (c.SocksUsername(V2RayWs) != tt.username ||
+				c.SocksPassword(V2RayWs) != tt.password) {
+
+				t.Errorf("credentials = %q, %q", c.SocksUsername(V2RayWs), c.SocksPassword(V2RayWs))
+			}
+		})
+	}
+}
+
+func TestSocksCredentialsUnsupported(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+
+	// They receive PT arguments in the SOCKS5 username and password.
+	for _, methodName := range []string{Obfs4, MeekLite, Webtunnel, Snowflake} {
+		if err := c.GenerateSocksCredentials(methodName); err == nil {
+			t.Errorf("GenerateSocksCredentials(%s) = nil, want error", methodName)
+		}
+
+		if c.SocksUsername(methodName) != "" {
+			t.Errorf("SocksUsername(%s) = %q, want \"\"", methodName, c.SocksUsername(methodName))
+		}
+	}
+}
+
+func TestSocksAuth(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+
+	if err := c.SetSocksCredentials(V2RayWs, "user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeFactory{dial: func(base.DialFunc) (net.Conn, error) {
+		client, server := net.Pipe()
+		_ = server.Close()
+
+		return client, nil
+	}}
+
+	startFake(t, c, Obfs4, f)
+	defer c.Stop(Obfs4)
+
+	long := "cert=" + strings.Repeat("a", 300)
+
+	tests := []struct {
+		name       string
+		methodName string
+		ptArgs     string
+		want       *proxy.Auth
+	}{
+		{"PT arguments", Obfs4, "cert=abc;iat-mode=0", &proxy.Auth{User: "cert=abc;iat-mode=0", Password: "\x00"}},
+		{"long PT arguments", Obfs4, long, &proxy.Auth{User: long[:255], Password: long[255:]}},
+		{"no PT arguments", Obfs4, "", nil},
+		{"credentials", V2RayWs, "cert=abc", &proxy.Auth{User: "user", Password: "pass"}},
+		{"no credentials", V2RaySrtp, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.socksAuth(tt.methodName, tt.ptArgs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("socksAuth() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package IEnvoyProxy
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// StateVersion - Version of the layout of `StateDir`:
+//
+//	StateDir/
+//	  state_version  This version number.
+//	  iep.log        The log file, see `LogFileName`.
+//	  transports/    State the transports keep across launches, e.g. Lyrebird's ScrambleSuit session tickets.
+//	  sockets/       Unix domain sockets, only while transports listen on them.
+//	  hysteria.yaml  Hysteria2 configuration, only while Hysteria2 is running.
+//
+// Older layouts are migrated on construction of a `Controller`. Transport state of a newer, unknown layout is
+// wiped.
+const StateVersion = 1
+
+const (
+	// stateVersionFile - The file in `StateDir` containing the `StateVersion` the state was written with.
+	stateVersionFile = "state_version"
+
+	// transportStateDirName - The directory in `StateDir` the transports keep their state in.
+	transportStateDirName = "transports"
+)
+
+// legacyStateFiles - Transport state, which was kept directly in `StateDir` before version 1.
+var legacyStateFiles = []string{"scramblesuit_tickets.json"}
+
+// migrateState - Bring the layout of the state directory up to `StateVersion`.
+//
+// @throws if the state directory cannot be read or written.
+func migrateState(stateDir string) error {
+	version := 0
+
+	data, err := os.ReadFile(filepath.Join(stateDir, stateVersionFile))
+	if err == nil {
+		version, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			ptlog.Warnf("Invalid state version %q, wiping transport state", strings.TrimSpace(string(data)))
+			version = StateVersion + 1
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if version == StateVersion {
+		return os.MkdirAll(filepath.Join(stateDir, transportStateDirName), 0700)
+	}
+
+	if version > StateVersion {
+		ptlog.Warnf("State version %d is newer than %d, wiping transport state", version, StateVersion)
+
+		if err = os.RemoveAll(filepath.Join(stateDir, transportStateDirName)); err != nil {
+			return err
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Join(stateDir, transportStateDirName), 0700); err != nil {
+		return err
+	}
+
+	if version < 1 {
+		for _, name := range legacyStateFiles {
+			err = os.Rename(filepath.Join(stateDir, name), filepath.Join(stateDir, transportStateDirName, name))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	return os.WriteFile(filepath.Join(stateDir, stateVersionFile), []byte(strconv.Itoa(StateVersion)+"\n"), 0600)
+}
+
+// transportStateDir - The directory the transports keep their state in.
+func (c *Controller) transportStateDir() string {
+	return filepath.Join(c.stateDir, transportStateDirName)
+}
+
+// StateFiles - List the state the transports keep across launches.
+//
+// @returns a newline-separated list of file paths relative to `StateDir`, each followed by a tab and its size
+// in bytes. Empty, if there is no state.
+//
+// @throws if the state directory cannot be read.
+func (c *Controller) StateFiles() (string, error) {
+	var files []string
+
+	err := c.walkTransportState(func(name string, info fs.FileInfo) error {
+		files = append(files, fmt.Sprintf("%s\t%d", name, info.Size()))
+
+		return nil
+	})
+
+	return strings.Join(files, "\n"), err
+}
+
+// ExportState - Write the state the transports keep across launches to a ZIP archive, e.g. for debugging.
+//
+// The archive contains the `state_version` file and the `transports` directory, with paths relative to
+// `StateDir`. Logs are not included.
+//
+// @param destination The path of the archive. Overwritten, if it exists.
+//
+// @throws if the state directory cannot be read or the archive cannot be written.
+func (c *Controller) ExportState(destination string) error {
+	out, err := os.OpenFile(destination, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(out)
+
+	err = addToArchive(archive, filepath.Join(c.stateDir, stateVersionFile), stateVersionFile)
+
+	if err == nil {
+		err = c.walkTransportState(func(name string, _ fs.FileInfo) error {
+			return addToArchive(archive, filepath.Join(c.stateDir, name), name)
+		})
+	}
+
+	if err2 := archive.Close(); err == nil {
+		err = err2
+	}
+
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+
+	if err != nil {
+		_ = os.Remove(destination)
+	}
+
+	return err
+}
+
+// WipeState - Delete the state the transports keep across launches, e.g. to reset network settings.
+//
+// Logs are kept.
+//
+// @throws if a Lyrebird or Snowflake transport is running, as these use the state, or if it cannot be deleted.
+func (c *Controller) WipeState() error {
+	if len(c.listeners) > 0 {
+		var running []string
+
+		for methodName := range c.listeners {
+			running = append(running, methodName)
+		}
+
+		slices.Sort(running)
+
+		return fmt.Errorf("stop %s first", strings.Join(running, ", "))
+	}
+
+	if err := os.RemoveAll(c.transportStateDir()); err != nil {
+		return err
+	}
+
+	ptlog.Noticef("Wiped transport state")
+
+	return migrateState(c.stateDir)
+}
+
+// walkTransportState - Call fn for each regular file in the transport state directory.
+//
+// @param fn Gets the file path relative to `StateDir`, using forward slashes.
+func (c *Controller) walkTransportState(fn func(name string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(c.transportStateDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(c.stateDir, path)
+		if err != nil {
+			return err
+		}
+
+		return fn(filepath.ToSlash(name), info)
+	})
+}
+
+// addToArchive - Copy a file into a ZIP archive.
+func addToArchive(archive *zip.Writer, path, name string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+
+	return err
+}
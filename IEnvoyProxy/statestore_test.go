@@ -0,0 +1,166 @@
+package IEnvoyProxy
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestMigrateLegacyState(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "scramblesuit_tickets.json"), `{"ticket":1}`)
+
+	c := NewController(dir, false, false, "ERROR", nil)
+
+	if _, err := os.Stat(filepath.Join(dir, "scramblesuit_tickets.json")); !os.IsNotExist(err) {
+		t.Errorf("legacy tickets still in StateDir: %v", err)
+	}
+
+	if got := readFile(t, filepath.Join(dir, "transports", "scramblesuit_tickets.json")); got != `{"ticket":1}` {
+		t.Errorf("migrated tickets = %q", got)
+	}
+
+	if got := readFile(t, filepath.Join(dir, stateVersionFile)); got != "1\n" {
+		t.Errorf("state version = %q", got)
+	}
+
+	files, err := c.StateFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if files != "transports/scramblesuit_tickets.json\t12" {
+		t.Errorf("StateFiles() = %q", files)
+	}
+
+	// Migrating again doesn't touch the current layout.
+	if err = migrateState(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, filepath.Join(dir, "transports", "scramblesuit_tickets.json")); got != `{"ticket":1}` {
+		t.Errorf("tickets after second migration = %q", got)
+	}
+}
+
+func TestMigrateNewerState(t *testing.T) {
+	for _, version := range []string{"2\n", "garbage"} {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, stateVersionFile), version)
+		writeFile(t, filepath.Join(dir, "transports", "future.bin"), "unknown")
+		writeFile(t, filepath.Join(dir, LogFileName), "log")
+
+		if err := migrateState(dir); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "transports", "future.bin")); !os.IsNotExist(err) {
+			t.Errorf("version %q: state of newer version not wiped: %v", version, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, LogFileName)); err != nil {
+			t.Errorf("version %q: log wiped: %v", version, err)
+		}
+
+		if got := readFile(t, filepath.Join(dir, stateVersionFile)); got != "1\n" {
+			t.Errorf("version %q: state version = %q", version, got)
+		}
+	}
+}
+
+func TestExportState(t *testing.T) {
+	dir := t.TempDir()
+	c := NewController(dir, false, false, "ERROR", nil)
+	writeFile(t, filepath.Join(dir, "transports", "a", "b.json"), "b")
+	writeFile(t, filepath.Join(dir, LogFileName), "log")
+
+	destination := filepath.Join(t.TempDir(), "state.zip")
+
+	if err := c.ExportState(destination); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.OpenReader(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer archive.Close()
+
+	contents := map[string]string{}
+
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, _ := io.ReadAll(r)
+		_ = r.Close()
+
+		contents[f.Name] = string(data)
+	}
+
+	if len(contents) != 2 || contents[stateVersionFile] != "1\n" || contents["transports/a/b.json"] != "b" {
+		t.Errorf("archive contents = %q", contents)
+	}
+}
+
+func TestWipeState(t *testing.T) {
+	dir := t.TempDir()
+	c := NewController(dir, false, false, "ERROR", nil)
+	writeFile(t, filepath.Join(dir, "transports", "tickets.json"), "{}")
+
+	if err := c.Start(Obfs4, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.WipeState()
+	if err == nil || !strings.Contains(err.Error(), Obfs4) {
+		t.Errorf("WipeState() while running error = %v, want to stop %s first", err, Obfs4)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "transports", "tickets.json")); err != nil {
+		t.Errorf("state wiped while running: %v", err)
+	}
+
+	c.Stop(Obfs4)
+
+	if err = c.WipeState(); err != nil {
+		t.Fatal(err)
+	}
+
+	if files, _ := c.StateFiles(); files != "" {
+		t.Errorf("StateFiles() after wipe = %q", files)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "transports")); err != nil {
+		t.Errorf("transport state directory not recreated: %v", err)
+	}
+}
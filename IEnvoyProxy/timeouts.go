@@ -0,0 +1,238 @@
+package IEnvoyProxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+	"golang.org/x/net/proxy"
+)
+
+// Default timeouts, see `SetTimeouts`.
+const (
+	defaultConnectTimeout   = 15 * time.Second
+	defaultHandshakeTimeout = 30 * time.Second
+)
+
+// errHandshakeTimeout - Reported, when a transport didn't finish its handshake in time.
+var errHandshakeTimeout = errors.New("handshake timed out")
+
+// dialTimeouts - How long a Lyrebird transport may take to connect to its server.
+type dialTimeouts struct {
+	connect   time.Duration
+	handshake time.Duration
+}
+
+// SetTimeouts - Give up on connections of a Lyrebird transport to its server, which take too long, instead of
+// waiting for the operating system's TCP timeout, which can take minutes on mobile networks.
+//
+// Takes effect with the next `Start` of the given transport. Failed connections are reported with
+// `OnTransportStopped` as `ErrorKindTimeout`.
+//
+// @param methodName one of the constants `Obfs4`, `MeekLite`, `Webtunnel`, `Obfs4TubeSocks` or
+// `MeekLiteTubeSocks`. The latter use the timeouts of `Obfs4` resp. `MeekLite`.
+//
+// @param connectTimeout Seconds to wait for a TCP connection, including the upstream proxy, if any.
+// 0 or less for the default of 15 seconds.
+//
+// @param handshakeTimeout Seconds to wait for the transport's handshake with the server, once connected.
+// 0 or less for the default of 30 seconds.
+func (c *Controller) SetTimeouts(methodName string, connectTimeout, handshakeTimeout int) {
+	timeouts := dialTimeouts{
+		connect:   time.Duration(connectTimeout) * time.Second,
+		handshake: time.Duration(handshakeTimeout) * time.Second,
+	}
+
+	if timeouts.connect <= 0 {
+		timeouts.connect = defaultConnectTimeout
+	}
+
+	if timeouts.handshake <= 0 {
+		timeouts.handshake = defaultHandshakeTimeout
+	}
+
+	c.timeouts[methodName] = timeouts
+}
+
+// dialTimeouts - The timeouts of the given transport.
+func (c *Controller) dialTimeouts(methodName string) dialTimeouts {
+	if timeouts, ok := c.timeouts[methodName]; ok {
+		return timeouts
+	}
+
+	return dialTimeouts{connect: defaultConnectTimeout, handshake: defaultHandshakeTimeout}
+}
+
+// dialTransport - Connect a Lyrebird transport to its server, giving up after the connect timeout for each TCP
+// connection and after the handshake timeout, once the first one is established.
+//
+// @param ctx Cancels dialing. Returns right away then and closes the connections the transport opened so far,
+// also for transports like Snowflake, which cannot be cancelled.
+//
+// @param proxyURL The proxy to connect through or nil.
+//
+// @throws if the proxy URL cannot be used, the transport fails to connect or a timeout expires.
+func dialTransport(ctx context.Context, f base.ClientFactory, target string, proxyURL *url.URL, args interface{},
+	timeouts dialTimeouts) (net.Conn, error) {
+
+	dnsResolver := sharedResolver.netResolver()
+
+	var dialer proxy.Dialer = &net.Dialer{Resolver: dnsResolver}
+
+	if proxyURL != nil {
+		var err error
+
+		dialer, err = proxy.FromURL(proxyURL, &net.Dialer{Timeout: timeouts.connect, Resolver: dnsResolver})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h := &handshake{timeout: timeouts.handshake}
+
+	dialFn := func(network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeouts.connect)
+		defer cancel()
+
+		var conn net.Conn
+		var err error
+
+		if d, ok := dialer.(proxy.ContextDialer); ok {
+			conn, err = d.DialContext(ctx, network, address)
+		} else {
+			conn, err = dialer.Dial(network, address)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return h.track(conn)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		h.abort(ctx.Err())
+	})
+	defer stop()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	results := make(chan result, 1)
+
+	go func() {
+		conn, err := f.Dial("tcp", target, sharedResolver.dialer(dialFn), args)
+		results <- result{conn, err}
+	}()
+
+	var r result
+
+	select {
+	case r = <-results:
+	case <-ctx.Done():
+		// Close the connection, should the transport still come up.
+		go func() {
+			if r := <-results; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+
+		h.abort(ctx.Err())
+		h.finish()
+
+		return nil, ctx.Err()
+	}
+
+	if err := h.finish(); err != nil {
+		if r.conn != nil {
+			_ = r.conn.Close()
+		}
+
+		return nil, err
+	}
+
+	return r.conn, r.err
+}
+
+// handshake - Closes the connections a transport opens during its handshake, when it takes too long or dialing
+// is cancelled.
+//
+// Transports like obfs4 set their own deadlines, so the connections need to be closed instead.
+type handshake struct {
+	timeout time.Duration
+
+	timer *time.Timer
+	conns []net.Conn
+	done  bool
+
+	// err - Why the handshake was aborted.
+	err   error
+	mutex sync.Mutex
+}
+
+// track - Watch a connection, the first one starts the timer. Connections opened after the handshake, like meek's
+// HTTP requests, are left alone.
+//
+// @throws if the handshake was aborted already.
+func (h *handshake) track(conn net.Conn) (net.Conn, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.err != nil {
+		_ = conn.Close()
+		return nil, h.err
+	}
+
+	if h.done {
+		return conn, nil
+	}
+
+	h.conns = append(h.conns, conn)
+
+	if h.timer == nil {
+		h.timer = time.AfterFunc(h.timeout, func() {
+			h.abort(errHandshakeTimeout)
+		})
+	}
+
+	return conn, nil
+}
+
+// abort - Close all connections opened during the handshake.
+func (h *handshake) abort(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.done || h.err != nil {
+		return
+	}
+
+	h.err = err
+
+	for _, conn := range h.conns {
+		_ = conn.Close()
+	}
+}
+
+// finish - Stop the timer.
+//
+// @returns why the handshake was aborted, if it was.
+func (h *handshake) finish() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+
+	h.done = true
+	h.conns = nil
+
+	return h.err
+}
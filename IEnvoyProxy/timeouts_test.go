@@ -0,0 +1,132 @@
+package IEnvoyProxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+)
+
+// silentServer - Accepts TCP connections and never answers.
+//
+// @returns the address and the accepted connections.
+func silentServer(t *testing.T) (string, chan net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+
+	conns := make(chan net.Conn, 10)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			conns <- conn
+		}
+	}()
+
+	return ln.Addr().String(), conns
+}
+
+// dialWithin - Dial with a fake transport and check, that it fails with a timeout in time.
+func dialWithin(t *testing.T, f base.ClientFactory, proxyURL *url.URL, timeouts dialTimeouts,
+	limit time.Duration) error {
+
+	t.Helper()
+
+	start := time.Now()
+
+	conn, err := dialTransport(context.Background(), f, "192.0.2.1:443", proxyURL, nil, timeouts)
+	if err == nil {
+		_ = conn.Close()
+		t.Fatal("dialTransport() succeeded, want timeout")
+	}
+
+	if elapsed := time.Since(start); elapsed > limit {
+		t.Errorf("dialTransport() took %s, want less than %s", elapsed, limit)
+	}
+
+	if kind := ErrorKind(newTransportError(Obfs4, "", err)); kind != ErrorKindTimeout {
+		t.Errorf("ErrorKind() = %q, want %q: %v", kind, ErrorKindTimeout, err)
+	}
+
+	return err
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// An upstream proxy, which accepts, but never answers, blackholes the connection.
+	address, _ := silentServer(t)
+	proxyURL := &url.URL{Scheme: "socks5", Host: address}
+
+	f := &fakeFactory{dial: func(dialFn base.DialFunc) (net.Conn, error) {
+		return dialFn("tcp", "192.0.2.1:443")
+	}}
+
+	dialWithin(t, f, proxyURL, dialTimeouts{connect: 200 * time.Millisecond, handshake: time.Minute}, 5*time.Second)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	address, conns := silentServer(t)
+
+	// Like obfs4, waits for the server's handshake, which never comes.
+	f := &fakeFactory{dial: func(dialFn base.DialFunc) (net.Conn, error) {
+		conn, err := dialFn("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = conn.Read(make([]byte, 1)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+
+		return conn, nil
+	}}
+
+	err := dialWithin(t, f, nil, dialTimeouts{connect: time.Minute, handshake: 200 * time.Millisecond}, 5*time.Second)
+
+	if !errors.Is(err, errHandshakeTimeout) {
+		t.Errorf("dialTransport() error = %v, want %v", err, errHandshakeTimeout)
+	}
+
+	select {
+	case conn := <-conns:
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		var netErr net.Error
+		if _, err = conn.Read(make([]byte, 1)); errors.As(err, &netErr) && netErr.Timeout() {
+			t.Error("connection of the timed out handshake not closed")
+		}
+
+	default:
+		t.Error("transport didn't connect")
+	}
+}
+
+func TestSetTimeouts(t *testing.T) {
+	c := NewController(t.TempDir(), false, false, "ERROR", nil)
+
+	if got := c.dialTimeouts(Obfs4); got != (dialTimeouts{defaultConnectTimeout, defaultHandshakeTimeout}) {
+		t.Errorf("default timeouts = %+v", got)
+	}
+
+	c.SetTimeouts(Obfs4, 5, 0)
+
+	if got := c.dialTimeouts(Obfs4); got != (dialTimeouts{5 * time.Second, defaultHandshakeTimeout}) {
+		t.Errorf("timeouts = %+v", got)
+	}
+}
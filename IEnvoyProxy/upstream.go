@@ -0,0 +1,355 @@
+package IEnvoyProxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/txthinking/socks5"
+	v2ray "github.com/v2fly/v2ray-core/v5/envoy"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"golang.org/x/net/proxy"
+)
+
+// upstreamDialTimeout - How long to wait for an upstream proxy to set up a connection.
+const upstreamDialTimeout = 30 * time.Second
+
+func init() {
+	// golang.org/x/net/proxy only knows SOCKS5. Lyrebird registers its HTTP dialer in its command only.
+	proxy.RegisterDialerType("http", newHttpConnectDialer)
+}
+
+// needsUdp - Whether the given transport talks UDP to its server.
+func needsUdp(methodName string) bool {
+	switch methodName {
+	case Snowflake, V2RaySrtp, V2RayWechat, Hysteria2:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// upstreamSchemes - The upstream proxy schemes the given transport supports.
+//
+// Transports which talk UDP to their server need a SOCKS5 proxy supporting UDP ASSOCIATE.
+func upstreamSchemes(methodName string) []string {
+	if needsUdp(methodName) {
+		return []string{"socks5"}
+	}
+
+	return []string{"http", "socks5", "socks5h"}
+}
+
+// parseUpstreamProxy - Parse an upstream proxy URL and check, if the given transport supports it.
+//
+// @returns nil, if proxy is empty.
+//
+// @throws if the URL cannot be parsed, misses host or port, or if the transport doesn't support its scheme.
+func parseUpstreamProxy(methodName, proxy string) (*url.URL, error) {
+	if strings.TrimSpace(proxy) == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(strings.TrimSpace(proxy))
+	if err != nil {
+		return nil, err
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy %s needs a host and a port", u.Redacted())
+	}
+
+	if schemes := upstreamSchemes(methodName); !slices.Contains(schemes, u.Scheme) {
+		return nil, fmt.Errorf("%s does not support %s proxies, only %s", methodName, u.Scheme,
+			strings.Join(schemes, ", "))
+	}
+
+	return u, nil
+}
+
+// v2rayUpstream - Translate an upstream proxy URL into V2Ray's terms.
+func v2rayUpstream(u *url.URL) v2ray.Upstream {
+	if u == nil {
+		return v2ray.Upstream{}
+	}
+
+	upstream := v2ray.Upstream{Protocol: "socks", Host: u.Hostname()}
+	upstream.Port, _ = net.LookupPort("tcp", u.Port())
+
+	if u.Scheme == "http" {
+		upstream.Protocol = "http"
+	}
+
+	if u.User != nil {
+		upstream.Username = u.User.Username()
+		upstream.Password, _ = u.User.Password()
+	}
+
+	return upstream
+}
+
+// httpConnectDialer - Dials through an HTTP proxy using CONNECT.
+type httpConnectDialer struct {
+	address       string
+	authorization string
+	forward       proxy.Dialer
+}
+
+func newHttpConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	d := &httpConnectDialer{address: u.Host, forward: forward}
+
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		d.authorization = "Basic " + credentials
+	}
+
+	return d, nil
+}
+
+// Dial - Connect to the given address through the HTTP proxy.
+func (d *httpConnectDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext - Connect to the given address through the HTTP proxy, giving up, when ctx is done.
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+
+	if forward, ok := d.forward.(proxy.ContextDialer); ok {
+		conn, err = forward.DialContext(ctx, "tcp", d.address)
+	} else {
+		conn, err = d.forward.Dial("tcp", d.address)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(upstreamDialTimeout))
+
+	// Unblock the CONNECT request, when ctx is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+
+	if d.authorization != "" {
+		req.Header.Set("Proxy-Authorization", d.authorization)
+	}
+
+	br := bufio.NewReader(conn)
+
+	err = req.Write(conn)
+	if err == nil {
+		var res *http.Response
+
+		res, err = http.ReadResponse(br, req)
+		if err == nil && res.StatusCode != http.StatusOK {
+			err = fmt.Errorf("HTTP proxy refused to connect: %s", res.Status)
+		}
+	}
+
+	if err == nil && !stop() {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	// The proxy might already have sent data from the destination.
+	return &bufferedConn{conn, br}, nil
+}
+
+// udpRelay - Relays UDP datagrams between a local port and a fixed destination through a SOCKS5 proxy,
+// for transports which cannot use a proxy themselves, or to the IP addresses of a pinned domain with a
+// `pinnedConn`, for transports which cannot switch between them themselves.
+type udpRelay struct {
+	local  net.PacketConn
+	remote net.Conn
+	peer   atomic.Pointer[net.Addr]
+}
+
+// startUdpRelay - Set up a SOCKS5 UDP association and start relaying.
+//
+// @param u A SOCKS5 proxy supporting UDP ASSOCIATE.
+//
+// @param destination Where to send all datagrams to, as "host:port". The proxy resolves host names.
+//
+// @throws if the proxy cannot be reached or doesn't support UDP ASSOCIATE.
+func startUdpRelay(u *url.URL, destination string) (*udpRelay, error) {
+	var username, password string
+
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	client, err := socks5.NewClient(u.Host, username, password, int(upstreamDialTimeout.Seconds()), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := client.Dial("udp", destination)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s does not relay UDP: %w", u.Redacted(), err)
+	}
+
+	return newUdpRelay(remote)
+}
+
+// newUdpRelay - Start relaying between a new local port and the given connection. Closes it on failure.
+//
+// @throws if the local port cannot be opened.
+func newUdpRelay(remote net.Conn) (*udpRelay, error) {
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		_ = remote.Close()
+		return nil, err
+	}
+
+	r := &udpRelay{local: local, remote: remote}
+
+	go r.toRemote()
+	go r.toLocal()
+
+	return r, nil
+}
+
+// addr - The local address to send datagrams to.
+func (r *udpRelay) addr() string {
+	return r.local.LocalAddr().String()
+}
+
+// close - Stop relaying and end the UDP association. Safe to call more than once.
+func (r *udpRelay) close() {
+	_ = r.local.Close()
+	_ = r.remote.Close()
+}
+
+// stopOn - Whether relaying has to stop after the given read error, which is all but temporary ones. Closes the
+// relay then, so the other direction stops, too.
+func (r *udpRelay) stopOn(err error, from string) bool {
+	var e net.Error
+	if errors.As(err, &e) && e.Temporary() {
+		return false
+	}
+
+	if !errors.Is(err, net.ErrClosed) {
+		ptlog.Warnf("UDP relay: Failed to read from %s, stopping: %s", from, ptlog.ElideError(err))
+	}
+
+	r.close()
+
+	return true
+}
+
+func (r *udpRelay) toRemote() {
+	buf := make([]byte, 65535)
+
+	for {
+		n, peer, err := r.local.ReadFrom(buf)
+		if err != nil {
+			if r.stopOn(err, "transport") {
+				return
+			}
+
+			continue
+		}
+
+		// The transport might use a new local port after reconnecting.
+		r.peer.Store(&peer)
+
+		if _, err = r.remote.Write(buf[:n]); err != nil {
+			ptlog.Debugf("UDP relay: Failed to send to proxy: %s", ptlog.ElideError(err))
+		}
+	}
+}
+
+func (r *udpRelay) toLocal() {
+	buf := make([]byte, 65535)
+
+	for {
+		n, err := r.remote.Read(buf)
+		if err != nil {
+			if r.stopOn(err, "proxy") {
+				return
+			}
+
+			continue
+		}
+
+		if peer := r.peer.Load(); peer != nil {
+			_, _ = r.local.WriteTo(buf[:n], *peer)
+		}
+	}
+}
+
+// startHysteria2Relay - Relay Hysteria2's QUIC traffic through the given SOCKS5 proxy, as Hysteria2 cannot use
+// a proxy itself.
+//
+// The original host is kept as TLS server name, unless `Hysteria2Server` already sets one.
+//
+// @returns the `Hysteria2Server` URL rewritten to point to the relay.
+//
+// @throws if `Hysteria2Server` cannot be parsed or uses port hopping, or if the relay cannot be set up.
+func (c *Controller) startHysteria2Relay(u *url.URL) (string, error) {
+	server, err := url.Parse(c.Hysteria2Server)
+	if err != nil {
+		err = fmt.Errorf("invalid Hysteria2 server URL (port hopping is not supported with a proxy): %w", err)
+
+		return "", newTransportError(Hysteria2, ErrorKindConfig, err)
+	}
+
+	if server.Hostname() == "" {
+		err = errors.New("invalid Hysteria2 server URL: host missing")
+
+		return "", newTransportError(Hysteria2, ErrorKindConfig, err)
+	}
+
+	port := server.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	relay, err := startUdpRelay(u, net.JoinHostPort(server.Hostname(), port))
+	if err != nil {
+		return "", err
+	}
+
+	query := server.Query()
+	if query.Get("sni") == "" {
+		query.Set("sni", server.Hostname())
+	}
+
+	server.Host = relay.addr()
+	server.RawQuery = query.Encode()
+
+	c.hysteria2Relay = relay
+
+	return server.String(), nil
+}
@@ -0,0 +1,282 @@
+package IEnvoyProxy
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	v2ray "github.com/v2fly/v2ray-core/v5/envoy"
+	"golang.org/x/net/proxy"
+)
+
+func TestParseUpstreamProxy(t *testing.T) {
+	tests := []struct {
+		methodName string
+		proxy      string
+		want       string
+		wantErr    bool
+	}{
+		{methodName: Obfs4, proxy: "", want: ""},
+		{methodName: Obfs4, proxy: " HTTP://u:p@127.0.0.1:8080 ", want: "http://u:p@127.0.0.1:8080"},
+		{methodName: MeekLite, proxy: "socks5h://proxy.example:1080", want: "socks5h://proxy.example:1080"},
+		{methodName: V2RayWs, proxy: "socks5://127.0.0.1:1080", want: "socks5://127.0.0.1:1080"},
+		{methodName: Hysteria2, proxy: "SOCKS5://127.0.0.1:1080", want: "socks5://127.0.0.1:1080"},
+
+		{methodName: Obfs4, proxy: "127.0.0.1:8080", wantErr: true},
+		{methodName: Obfs4, proxy: "http://127.0.0.1", wantErr: true},
+		{methodName: Obfs4, proxy: "https://127.0.0.1:443", wantErr: true},
+		{methodName: Obfs4, proxy: "http://[::1", wantErr: true},
+		{methodName: Snowflake, proxy: "http://127.0.0.1:8080", wantErr: true},
+		{methodName: V2RaySrtp, proxy: "socks5h://127.0.0.1:1080", wantErr: true},
+		{methodName: V2RayWechat, proxy: "http://127.0.0.1:8080", wantErr: true},
+		{methodName: Hysteria2, proxy: "http://127.0.0.1:8080", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		u, err := parseUpstreamProxy(tt.methodName, tt.proxy)
+
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseUpstreamProxy(%s, %q) = %v, want error", tt.methodName, tt.proxy, u)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseUpstreamProxy(%s, %q) error = %v", tt.methodName, tt.proxy, err)
+			continue
+		}
+
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+
+		if got != tt.want {
+			t.Errorf("parseUpstreamProxy(%s, %q) = %q, want %q", tt.methodName, tt.proxy, got, tt.want)
+		}
+	}
+}
+
+func TestV2RayUpstream(t *testing.T) {
+	if got := v2rayUpstream(nil); got != (v2ray.Upstream{}) {
+		t.Errorf("v2rayUpstream(nil) = %+v", got)
+	}
+
+	u, _ := url.Parse("http://u:p@proxy.example:3128")
+	want := v2ray.Upstream{Protocol: "http", Host: "proxy.example", Port: 3128, Username: "u", Password: "p"}
+
+	if got := v2rayUpstream(u); got != want {
+		t.Errorf("v2rayUpstream(%s) = %+v, want %+v", u, got, want)
+	}
+
+	u, _ = url.Parse("socks5h://[::1]:1080")
+	want = v2ray.Upstream{Protocol: "socks", Host: "::1", Port: 1080}
+
+	if got := v2rayUpstream(u); got != want {
+		t.Errorf("v2rayUpstream(%s) = %+v, want %+v", u, got, want)
+	}
+}
+
+func TestHttpConnectDialer(t *testing.T) {
+	server := newTestHttpProxy(t, &socksCredentials{username: "user", password: "pass"})
+	target := echoServer(t)
+
+	u, _ := url.Parse(server.URL)
+	u.User = url.UserPassword("user", "wrong")
+
+	d, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = d.Dial("tcp", target); err == nil {
+		t.Error("Dial() with wrong credentials: want error")
+	}
+
+	u.User = url.UserPassword("user", "pass")
+
+	if d, err = proxy.FromURL(u, proxy.Direct); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("read %q, %v, want %q", buf, err, "ping")
+	}
+}
+
+// scriptedConn - The proxy side of a UDP relay, which returns the reads it's given and records the writes.
+type scriptedConn struct {
+	net.Conn
+
+	reads  chan scriptedRead
+	writes chan []byte
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+type scriptedRead struct {
+	data []byte
+	err  error
+}
+
+// temporaryError - Like a transient network error.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func newScriptedConn() *scriptedConn {
+	return &scriptedConn{
+		reads:  make(chan scriptedRead),
+		writes: make(chan []byte, 10),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	select {
+	case read := <-c.reads:
+		return copy(b, read.data), read.err
+
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *scriptedConn) Write(b []byte) (int, error) {
+	c.writes <- append([]byte(nil), b...)
+
+	return len(b), nil
+}
+
+func (c *scriptedConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+
+	return nil
+}
+
+// newTestRelay - A relay between a local UDP port and the given proxy side, relaying in both directions.
+//
+// @returns the relay and a channel, which is closed, when both directions stopped.
+func newTestRelay(t *testing.T, remote net.Conn) (*udpRelay, chan struct{}) {
+	t.Helper()
+
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &udpRelay{local: local, remote: remote}
+	t.Cleanup(r.close)
+
+	var wg sync.WaitGroup
+	stopped := make(chan struct{})
+
+	wg.Add(2)
+
+	go func() {
+		r.toRemote()
+		wg.Done()
+	}()
+
+	go func() {
+		r.toLocal()
+		wg.Done()
+	}()
+
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	return r, stopped
+}
+
+func TestUdpRelayStopsOnError(t *testing.T) {
+	remote := newScriptedConn()
+	_, stopped := newTestRelay(t, remote)
+
+	remote.reads <- scriptedRead{err: io.EOF}
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay still running after a permanent error")
+	}
+
+	select {
+	case <-remote.closed:
+	default:
+		t.Error("UDP association not closed")
+	}
+}
+
+func TestUdpRelaySurvivesTemporaryErrors(t *testing.T) {
+	remote := newScriptedConn()
+	r, stopped := newTestRelay(t, remote)
+
+	client, err := net.Dial("udp", r.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(client net.Conn) {
+		_ = client.Close()
+	}(client)
+
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case sent := <-remote.writes:
+		if string(sent) != "ping" {
+			t.Errorf("relay sent %q, want \"ping\"", sent)
+		}
+
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay didn't send to the proxy")
+	}
+
+	remote.reads <- scriptedRead{err: temporaryError{}}
+	remote.reads <- scriptedRead{data: []byte("pong")}
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	buf := make([]byte, 10)
+
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("client got %q, %v, want \"pong\"", buf[:n], err)
+	}
+
+	r.close()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay still running after close")
+	}
+}